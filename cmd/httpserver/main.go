@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -10,23 +11,35 @@ import (
 	"os/signal"
 	"slices"
 	"strconv"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/junwei890/http-1.1/internal/headers"
+	"github.com/junwei890/http-1.1/internal/middleware"
 	"github.com/junwei890/http-1.1/internal/request"
 	"github.com/junwei890/http-1.1/internal/response"
+	"github.com/junwei890/http-1.1/internal/router"
 	"github.com/junwei890/http-1.1/internal/server"
 )
 
-const port = 42069
+const (
+	port = 42069
+	// how long in-flight requests get to finish once a shutdown signal is received
+	shutdownTimeout = 30 * time.Second
+)
 
 func main() {
+	rt := router.New()
+	rt.Handle("GET /", rootHandler)
+	rt.Handle("GET /httpbin/{route...}", httpbinHandler)
+	rt.Handle("GET /image", imageHandler)
+
+	handler := server.Chain(rt.Route, middleware.RequestID, middleware.Logger, middleware.Recover)
+
 	server, err := server.Serve(port, handler)
 	if err != nil {
 		log.Fatalf("couldn't start server: %v", err)
 	}
-	defer server.Close()
 
 	log.Printf("server started on port :%d\n", port)
 
@@ -34,110 +47,111 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("couldn't shutdown gracefully: %v", err)
+	}
+
 	log.Println("server shutdown")
 }
 
 // #nosec G104
-func handler(w *response.Writer, r *request.Request) {
-	if r.RequestLine.RequestTarget == "/" {
-		w.WriteStatusLine(response.StatusOK)
+func rootHandler(w *response.Writer, _ *request.Request) {
+	w.Header().Set("Content-Type", "text/html")
 
-		responseBody := []byte(
-			`<html>
+	w.Write([]byte(
+		`<html>
   <head>
     <title>Server</title>
   </head>
   <body>
     <h1>Hello World!</h1>
   </body>
-</html>`)
-
-		headers := response.SetDefaultHeaders(len(responseBody))
-		response.OverrideDefaultHeaders(headers, "Content-Type", "text/html")
-		w.WriteHeaders(headers)
-
-		w.WriteBody(responseBody)
-	} else if route, ok := strings.CutPrefix(r.RequestLine.RequestTarget, "/httpbin/"); ok {
-		// proxy for https://httpbin.org/ and a testing endpoint for chunked encoding and trailers
-		url := fmt.Sprintf("https://httpbin.org/%s", route)
-
-		client := &http.Client{}
-		res, err := client.Get(url)
-		if err != nil {
-			errorResponseHandler(w, r, err)
-			return
+</html>`))
+}
+
+// proxy for https://httpbin.org/ and a testing endpoint for chunked encoding and trailers
+// #nosec G104
+func httpbinHandler(w *response.Writer, r *request.Request) {
+	url := fmt.Sprintf("https://httpbin.org/%s", r.PathValue("route"))
+	// query parameters are passed along untouched, e.g. /httpbin/get?name=value
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+
+	client := &http.Client{}
+	res, err := client.Get(url)
+	if err != nil {
+		errorResponseHandler(w, r, err)
+		return
+	}
+	defer res.Body.Close()
+
+	w.WriteStatusLine(response.StatusOK)
+
+	h := response.SetDefaultHeaders(0)
+	// trailers must be declared in the headers
+	response.OverrideDefaultHeaders(h, "Trailers", "X-Content-SHA256, X-Content-Length")
+	response.OverrideDefaultHeaders(h, "Transfer-Encoding", "chunked")
+	w.WriteHeaders(h)
+
+	// keep reading from response till it ends, in real time
+	responseBody := []byte{}
+	buffer := make([]byte, 64)
+	for {
+		n, err := res.Body.Read(buffer)
+		if err != nil && err != io.EOF {
+			log.Printf("couldn't read response from %s: %v", url, err)
+			break
 		}
-		defer res.Body.Close()
-
-		w.WriteStatusLine(response.StatusOK)
-
-		h := response.SetDefaultHeaders(0)
-		// trailers must be declared in the headers
-		response.OverrideDefaultHeaders(h, "Trailers", "X-Content-SHA256, X-Content-Length")
-		response.OverrideDefaultHeaders(h, "Transfer-Encoding", "chunked")
-		w.WriteHeaders(h)
-
-		// keep reading from response till it ends, in real time
-		responseBody := []byte{}
-		buffer := make([]byte, 64)
-		for {
-			n, err := res.Body.Read(buffer)
-			if err != nil && err != io.EOF {
-				log.Printf("couldn't read response from %s: %v", url, err)
-				break
-			}
-			if err == io.EOF {
+		if err == io.EOF {
+			break
+		}
+		if n > 0 {
+			responseBody = slices.Concat(responseBody, buffer[:n])
+			if _, err := w.WriteChunkedBody(buffer[:n]); err != nil {
+				log.Printf("couldn't write chunked body from %s: %v", url, err)
 				break
 			}
-			if n > 0 {
-				responseBody = slices.Concat(responseBody, buffer[:n])
-				if _, err := w.WriteChunkedBody(buffer[:n]); err != nil {
-					log.Printf("couldn't write chunked body from %s: %v", url, err)
-					break
-				}
-			}
-		}
-
-		if _, err := w.WriteChunkedBodyDone(); err != nil {
-			log.Printf("couldn't terminate chunked body for %s: %v", url, err)
 		}
+	}
 
-		trailers := headers.NewHeaders()
-
-		hash := sha256.Sum256(responseBody)
-		contentLength := len(responseBody)
-		response.OverrideDefaultHeaders(trailers, "X-Content-SHA256", fmt.Sprintf("%x", hash))
-		response.OverrideDefaultHeaders(trailers, "X-Content-Length", strconv.Itoa(contentLength))
-
-		if err := w.WriteTrailers(trailers); err != nil {
-			log.Printf("couldn't write trailers for %s: %v", url, err)
-		}
-	} else if r.RequestLine.RequestTarget == "/image" {
-		// an endpoint to check if server supports binary data
-		file, err := os.ReadFile("./assets/panda.jpeg")
-		if err != nil {
-			errorResponseHandler(w, r, err)
-			return
-		}
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		log.Printf("couldn't terminate chunked body for %s: %v", url, err)
+	}
 
-		w.WriteStatusLine(response.StatusOK)
+	trailers := headers.NewHeaders()
 
-		headers := response.SetDefaultHeaders(len(file))
-		response.OverrideDefaultHeaders(headers, "Content-Type", "image/jpeg")
-		w.WriteHeaders(headers)
+	hash := sha256.Sum256(responseBody)
+	contentLength := len(responseBody)
+	response.OverrideDefaultHeaders(trailers, "X-Content-SHA256", fmt.Sprintf("%x", hash))
+	response.OverrideDefaultHeaders(trailers, "X-Content-Length", strconv.Itoa(contentLength))
 
-		w.WriteBody(file)
+	if err := w.WriteTrailers(trailers); err != nil {
+		log.Printf("couldn't write trailers for %s: %v", url, err)
 	}
 }
 
+// an endpoint to check if server supports binary data
 // #nosec G104
-func errorResponseHandler(w *response.Writer, _ *request.Request, err error) {
-	w.WriteStatusLine(response.StatusInternalServerError)
+func imageHandler(w *response.Writer, r *request.Request) {
+	file, err := os.ReadFile("./assets/panda.jpeg")
+	if err != nil {
+		errorResponseHandler(w, r, err)
+		return
+	}
 
-	responseBody := []byte(err.Error())
+	// content length is known upfront, so the image is written without being buffered
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(file)))
 
-	headers := response.SetDefaultHeaders(len(responseBody))
-	w.WriteHeaders(headers)
+	w.Write(file)
+}
 
-	w.WriteBody(responseBody)
+// #nosec G104
+func errorResponseHandler(w *response.Writer, _ *request.Request, err error) {
+	w.WriteHeader(response.StatusInternalServerError)
+	w.Write([]byte(err.Error()))
 }
@@ -3,19 +3,45 @@ package headers
 import (
 	"bytes"
 	"fmt"
+	"iter"
 	"regexp"
+	"slices"
 	"strings"
 )
 
-var regex = regexp.MustCompile(`[^a-z0-9!#$%&'*+\-.^_` + "`" + `|~]`)
+var regex = regexp.MustCompile(`[^A-Za-z0-9!#$%&'*+\-.^_` + "`" + `|~]`)
 
-type Headers map[string]string
+// a single field line, the name keeps the casing it was received or set with
+type field struct {
+	name  string
+	value string
+}
+
+// fields are kept in the order they were received or set, names are matched case insensitively
+type Headers struct {
+	fields []field
+}
 
-func NewHeaders() Headers {
-	return map[string]string{}
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+// position of the field with the given name, -1 if there isn't one
+func (h *Headers) index(name string) int {
+	if h == nil {
+		return -1
+	}
+
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, name) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	idx := bytes.Index(data, []byte("\r\n"))
 	if idx == -1 {
 		return 0, false, nil
@@ -25,35 +51,134 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 2, true, nil
 	}
 
-	// 2 substrings because whitespace is optional
-	parts := bytes.SplitN(data[:idx], []byte(":"), 2)
-	key := strings.ToLower(string(parts[0]))
-	if key != strings.TrimRight(key, " ") {
-		// whitespace allowed only before field name
-		return 0, false, fmt.Errorf("whitespace between field name and colon detected: %s", key)
+	line := data[:idx]
+	// a line starting with whitespace continues the previous field, which is obsolete line folding,
+	// before the first field it could hide a field from other parsers, rejected either way
+	if line[0] == ' ' || line[0] == '\t' {
+		return 0, false, fmt.Errorf("obsolete line folding or whitespace before field name detected: %q", line)
 	}
 
-	key = strings.TrimSpace(key)
-	value := strings.TrimSpace(string(parts[1]))
-
-	if regex.MatchString(strings.TrimSpace(key)) {
-		return 0, false, fmt.Errorf("invalid character in field name detected: %s", key)
+	name, value, found := bytes.Cut(line, []byte(":"))
+	if !found {
+		return 0, false, fmt.Errorf("field line without a colon detected: %q", line)
+	}
+	key := string(name)
+	if key == "" {
+		return 0, false, fmt.Errorf("empty field name detected: %q", line)
+	}
+	if key != strings.TrimRight(key, " \t") {
+		// no whitespace allowed between field name and colon
+		return 0, false, fmt.Errorf("whitespace between field name and colon detected: %q", key)
+	}
+	if regex.MatchString(key) {
+		return 0, false, fmt.Errorf("invalid character in field name detected: %q", key)
 	}
 
-	if _, ok := h[key]; ok {
-		newValue := fmt.Sprintf("%s, %s", h[key], value)
-		h[key] = newValue
-	} else {
-		h[key] = value
+	if !validValue(value) {
+		return 0, false, fmt.Errorf("invalid character in field value detected: %q", value)
 	}
 
+	// only spaces and tabs count as optional whitespace around the value, repeated fields are kept
+	// as separate lines and Get joins them when asked
+	h.Add(key, string(bytes.Trim(value, " \t")))
+
 	return idx + 2, false, nil
 }
 
-func (h Headers) Get(key string) (string, error) {
-	if _, ok := h[strings.ToLower(key)]; !ok {
-		return "", fmt.Errorf("%s header does not exist", key)
+// values can contain visible characters, spaces, tabs and bytes past ascii, control characters such
+// as a bare CR, LF or NUL are what let a value be read differently by different parsers
+func validValue(value []byte) bool {
+	for _, c := range value {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
 	}
 
-	return h[strings.ToLower(key)], nil
+	return true
+}
+
+// joins the values of repeated fields with ", ", which is equivalent for list based fields,
+// Set-Cookie is the exception since cookies can contain commas, so only the first is returned
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	if strings.EqualFold(key, "Set-Cookie") {
+		return values[0], true
+	}
+
+	return strings.Join(values, ", "), true
+}
+
+// every value of the field, one per field line
+func (h *Headers) Values(key string) []string {
+	values := []string{}
+	for name, value := range h.All() {
+		if strings.EqualFold(name, key) {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func (h *Headers) Has(key string) bool {
+	return h.index(key) != -1
+}
+
+// adds another field line, even if there is a field with the same name
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, field{name: key, value: value})
+}
+
+// replaces every line of an existing field with one where the first was, otherwise the field is
+// added at the end
+func (h *Headers) Set(key, value string) {
+	i := h.index(key)
+	if i == -1 {
+		h.Add(key, value)
+		return
+	}
+
+	h.fields[i].value = value
+	// later lines are deleted in place, the ones left are shifted to right after the first
+	rest := slices.DeleteFunc(h.fields[i+1:], func(f field) bool {
+		return strings.EqualFold(f.name, key)
+	})
+	h.fields = h.fields[:i+1+len(rest)]
+}
+
+// removes every line of the field
+func (h *Headers) Del(key string) {
+	if h == nil {
+		return
+	}
+
+	h.fields = slices.DeleteFunc(h.fields, func(f field) bool {
+		return strings.EqualFold(f.name, key)
+	})
+}
+
+func (h *Headers) Len() int {
+	if h == nil {
+		return 0
+	}
+
+	return len(h.fields)
+}
+
+// field names with their original casing and values, in order
+func (h *Headers) All() iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		if h == nil {
+			return
+		}
+
+		for _, f := range h.fields {
+			if !yield(f.name, f.value) {
+				return
+			}
+		}
+	}
 }
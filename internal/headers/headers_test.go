@@ -1,12 +1,20 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// value of the field, empty if there isn't one
+func get(h *Headers, key string) string {
+	value, _ := h.Get(key)
+
+	return value
+}
+
 func TestHeaderParse(t *testing.T) {
 	// test: valid single header
 	headers := NewHeaders()
@@ -14,28 +22,28 @@ func TestHeaderParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// test: valid single header with whitespace
 	headers = NewHeaders()
-	data = []byte(" Host: localhost:42069 \r\n")
+	data = []byte("Host: \tlocalhost:42069 \r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
 	// test: valid single header with existing headers
-	data = []byte(" Content-Type: application/json  \r\n")
+	data = []byte("Content-Type: application/json  \r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "application/json", headers["content-type"])
-	assert.Equal(t, 35, n)
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, "application/json", get(headers, "content-type"))
+	assert.Equal(t, 34, n)
 	assert.False(t, done)
 
 	// test: repeated header with existing headers
@@ -43,7 +51,7 @@ func TestHeaderParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "application/json, text/html", headers["content-type"])
+	assert.Equal(t, "application/json, text/html", get(headers, "content-type"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -53,7 +61,7 @@ func TestHeaderParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 22, n)
 	assert.False(t, done)
 
@@ -81,3 +89,166 @@ func TestHeaderParse(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 }
+
+func TestHeaderValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		// test: whitespace before the first field name
+		{name: "leading space", data: " Host: localhost:42069\r\n"},
+		// test: obsolete line folding
+		{name: "folded with space", data: " continued value\r\n"},
+		{name: "folded with tab", data: "\tcontinued value\r\n"},
+		// test: no colon, which used to index out of range
+		{name: "no colon", data: "Host localhost:42069\r\n"},
+		{name: "empty name", data: ": localhost:42069\r\n"},
+		{name: "tab before colon", data: "Host\t: localhost:42069\r\n"},
+		// test: control characters in the value
+		{name: "bare cr", data: "X-Test: a\rb\r\n"},
+		{name: "bare lf", data: "X-Test: a\nb\r\n"},
+		{name: "nul", data: "X-Test: a\x00b\r\n"},
+		{name: "del", data: "X-Test: a\x7fb\r\n"},
+		{name: "escape", data: "X-Test: \x1b[31m\r\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := NewHeaders()
+			n, done, err := headers.Parse([]byte(tc.data))
+			require.Error(t, err)
+			assert.Equal(t, 0, n)
+			assert.False(t, done)
+			assert.Equal(t, 0, headers.Len())
+		})
+	}
+
+	// test: tabs, empty values and bytes past ascii are fine
+	headers := NewHeaders()
+	for _, line := range []string{"X-Tab: a\tb\r\n", "X-Empty:\r\n", "X-Name: caf\xc3\xa9\r\n"} {
+		_, _, err := headers.Parse([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "a\tb", get(headers, "X-Tab"))
+	assert.True(t, headers.Has("X-Empty"))
+	assert.Equal(t, "café", get(headers, "X-Name"))
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"Host: localhost:42069\r\n",
+		"Content-Type: text/html  \r\n",
+		"\r\n",
+		" folded\r\n",
+		"Host localhost\r\n",
+		"X-Test: a\x00b\r\n",
+		":\r\n",
+		"Host: partial",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		headers := NewHeaders()
+		n, done, err := headers.Parse(data)
+		if err != nil {
+			assert.Equal(t, 0, n)
+			assert.Equal(t, 0, headers.Len())
+			return
+		}
+		assert.LessOrEqual(t, n, len(data))
+		if n == 0 || done {
+			assert.Equal(t, 0, headers.Len())
+			return
+		}
+
+		// whatever is accepted must be a well formed field
+		require.Equal(t, 1, headers.Len())
+		for name, value := range headers.All() {
+			assert.NotEmpty(t, name)
+			assert.False(t, regex.MatchString(name))
+			assert.True(t, validValue([]byte(value)))
+			assert.Equal(t, strings.Trim(value, " \t"), value)
+		}
+	})
+}
+
+func TestHeaderOrder(t *testing.T) {
+	// test: names keep their casing and fields keep their order
+	headers := NewHeaders()
+	for _, line := range []string{"Host: localhost\r\n", "X-Request-ID: abc\r\n", "accept: */*\r\n", "x-request-id: def\r\n"} {
+		_, _, err := headers.Parse([]byte(line))
+		require.NoError(t, err)
+	}
+	names := []string{}
+	values := []string{}
+	for name, value := range headers.All() {
+		names = append(names, name)
+		values = append(values, value)
+	}
+	assert.Equal(t, []string{"Host", "X-Request-ID", "accept", "x-request-id"}, names)
+	assert.Equal(t, []string{"localhost", "abc", "*/*", "def"}, values)
+
+	// test: lookups ignore case
+	assert.Equal(t, "abc, def", get(headers, "X-REQUEST-ID"))
+	_, ok := headers.Get("Content-Type")
+	assert.False(t, ok)
+
+	// test: set replaces a field where it is
+	headers.Set("HOST", "example.com")
+	headers.Set("Content-Type", "text/plain")
+	names = []string{}
+	for name := range headers.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Host", "X-Request-ID", "accept", "x-request-id", "Content-Type"}, names)
+	assert.Equal(t, "example.com", get(headers, "host"))
+
+	// test: delete removes every line
+	headers.Del("x-request-id")
+	assert.Equal(t, 3, headers.Len())
+	assert.Equal(t, "", get(headers, "X-Request-ID"))
+
+	// test: nil headers read as empty
+	var empty *Headers
+	assert.Equal(t, 0, empty.Len())
+	assert.Equal(t, "", get(empty, "Host"))
+}
+
+func TestHeaderValues(t *testing.T) {
+	// test: repeated fields are kept as separate lines
+	headers := NewHeaders()
+	headers.Add("Accept", "text/html")
+	headers.Add("Vary", "Accept")
+	headers.Add("accept", "application/json")
+	assert.Equal(t, []string{"text/html", "application/json"}, headers.Values("ACCEPT"))
+	assert.Equal(t, "text/html, application/json", get(headers, "Accept"))
+	assert.Equal(t, 3, headers.Len())
+	assert.True(t, headers.Has("vary"))
+	assert.False(t, headers.Has("Cookie"))
+	assert.Empty(t, headers.Values("Cookie"))
+
+	// test: set collapses every line into the first
+	headers.Set("Accept", "*/*")
+	assert.Equal(t, []string{"*/*"}, headers.Values("Accept"))
+	names := []string{}
+	for name := range headers.All() {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"Accept", "Vary"}, names)
+
+	// test: cookies are never joined
+	headers = NewHeaders()
+	headers.Add("Set-Cookie", "id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	headers.Add("Set-Cookie", "lang=en")
+	assert.Equal(t, "id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT", get(headers, "set-cookie"))
+	assert.Equal(t, []string{"id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "lang=en"}, headers.Values("Set-Cookie"))
+
+	// test: parsed repeats are separate lines too
+	headers = NewHeaders()
+	for _, line := range []string{"Set-Cookie: a=1\r\n", "Set-Cookie: b=2\r\n"} {
+		_, _, err := headers.Parse([]byte(line))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("Set-Cookie"))
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/junwei890/http-1.1/internal/request"
+	"github.com/junwei890/http-1.1/internal/response"
+	"github.com/junwei890/http-1.1/internal/server"
+)
+
+// field the request id is read from and echoed back in
+const RequestIDHeader = "X-Request-Id"
+
+// logs the request line and the status it was answered with, prefixed by the request id
+// when RequestID runs before it
+func Logger(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		next(w, r)
+
+		prefix := ""
+		if id, ok := r.Headers.Get(RequestIDHeader); ok {
+			prefix = "[" + id + "] "
+		}
+
+		// a handler that writes nothing is answered with a 200 once it returns
+		status := w.Status()
+		if status == 0 {
+			status = response.StatusOK
+		}
+
+		log.Printf("%s%s %s HTTP/%s, %d", prefix, r.RequestLine.Method, r.RequestLine.RequestTarget, r.RequestLine.HttpVersion, status)
+	}
+}
+
+// turns a panic in the handler into a 500, if the status line is already out the server is told
+// to drop the connection instead so the client can tell the response was cut short
+// #nosec G104
+func Recover(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// already dealt with by a Recover further in
+			if err == server.ErrAbortHandler {
+				panic(err)
+			}
+
+			log.Printf("panic handling %s %s: %v\n%s", r.RequestLine.Method, r.RequestLine.RequestTarget, err, debug.Stack())
+
+			// finishing the response would make it look complete
+			if w.StatusWritten() {
+				panic(server.ErrAbortHandler)
+			}
+
+			w.WriteError(response.StatusInternalServerError, "500 internal server error")
+		}()
+
+		next(w, r)
+	}
+}
+
+// tags the request with an id, reusing the one the client sent if any, and echoes it back
+// in the response so both sides can correlate logs
+func RequestID(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		id, ok := r.Headers.Get(RequestIDHeader)
+		if !ok || id == "" {
+			id = newRequestID()
+			r.Headers.Set(RequestIDHeader, id)
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+
+		next(w, r)
+	}
+}
+
+// #nosec G104
+func newRequestID() string {
+	id := make([]byte, 16)
+	// never returns an error
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// logs how long the handler took, including writing the response
+func Timing(next server.Handler) server.Handler {
+	return func(w *response.Writer, r *request.Request) {
+		start := time.Now()
+
+		next(w, r)
+
+		log.Printf("%s %s took %s", r.RequestLine.Method, r.RequestLine.RequestTarget, time.Since(start))
+	}
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/junwei890/http-1.1/internal/request"
+	"github.com/junwei890/http-1.1/internal/response"
+	"github.com/junwei890/http-1.1/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// #nosec G104
+func okHandler(w *response.Writer, _ *request.Request) {
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.SetDefaultHeaders(2))
+	w.WriteBody([]byte("ok"))
+}
+
+func serve(t *testing.T, handler server.Handler, rawRequest string) (string, *response.Writer, *request.Request) {
+	r, err := request.RequestParser(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+
+	buffer := &bytes.Buffer{}
+	w := response.NewWriter(buffer)
+	handler(w, r)
+
+	return buffer.String(), w, r
+}
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	buffer := &bytes.Buffer{}
+	log.SetOutput(buffer)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+
+	return buffer
+}
+
+func TestLogger(t *testing.T) {
+	logs := captureLogs(t)
+
+	// test: request line and status are logged
+	serve(t, Logger(okHandler), "GET /cats HTTP/1.1\r\n\r\n")
+	assert.Contains(t, logs.String(), "GET /cats HTTP/1.1, 200")
+
+	// test: request id is logged when tagged first
+	serve(t, server.Chain(okHandler, RequestID, Logger), "GET /cats HTTP/1.1\r\nX-Request-Id: abc\r\n\r\n")
+	assert.Contains(t, logs.String(), "[abc] GET /cats HTTP/1.1, 200")
+
+	// test: status the response will be sent with when the handler writes nothing
+	serve(t, Logger(func(w *response.Writer, r *request.Request) {}), "GET /empty HTTP/1.1\r\n\r\n")
+	assert.Contains(t, logs.String(), "GET /empty HTTP/1.1, 200")
+	serve(t, Logger(func(w *response.Writer, r *request.Request) {
+		w.WriteHeader(response.StatusNoContent)
+	}), "DELETE /cats HTTP/1.1\r\n\r\n")
+	assert.Contains(t, logs.String(), "DELETE /cats HTTP/1.1, 204")
+}
+
+func TestRecover(t *testing.T) {
+	logs := captureLogs(t)
+
+	// test: panic before anything is written becomes a 500
+	res, w, _ := serve(t, Recover(func(w *response.Writer, r *request.Request) {
+		panic("boom")
+	}), "GET / HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 500 Internal Server Error\r\n"))
+	assert.True(t, w.Closing())
+	assert.Contains(t, logs.String(), "boom")
+
+	// test: headers the handler set before panicking aren't sent with the 500
+	res, _, _ = serve(t, Recover(func(w *response.Writer, r *request.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Write([]byte("partial"))
+		panic("boom")
+	}), "GET / HTTP/1.1\r\n\r\n")
+	assert.NotContains(t, res, "Transfer-Encoding")
+	assert.NotContains(t, res, "Set-Cookie")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\n500 internal server error"))
+
+	// test: panic after the status line is written asks the server to drop the connection instead
+	assert.PanicsWithValue(t, server.ErrAbortHandler, func() {
+		serve(t, Recover(func(w *response.Writer, r *request.Request) {
+			w.WriteStatusLine(response.StatusOK)
+			panic("boom")
+		}), "GET / HTTP/1.1\r\n\r\n")
+	})
+
+	// test: nested recovers only log the panic once
+	logs.Reset()
+	assert.PanicsWithValue(t, server.ErrAbortHandler, func() {
+		serve(t, server.Chain(func(w *response.Writer, r *request.Request) {
+			w.WriteStatusLine(response.StatusOK)
+			panic("boom")
+		}, Recover, Recover), "GET / HTTP/1.1\r\n\r\n")
+	})
+	assert.Equal(t, 1, strings.Count(logs.String(), "boom"))
+
+	// test: no panic, nothing changes
+	res, w, _ = serve(t, Recover(okHandler), "GET / HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nok"))
+	assert.False(t, w.Closing())
+}
+
+func TestRequestID(t *testing.T) {
+	// test: id is generated and echoed back
+	res, _, r := serve(t, RequestID(okHandler), "GET / HTTP/1.1\r\n\r\n")
+	id, ok := r.Headers.Get(RequestIDHeader)
+	require.True(t, ok)
+	assert.Len(t, id, 32)
+	assert.Contains(t, res, "X-Request-Id: "+id+"\r\n")
+
+	// test: id sent by the client is reused
+	res, _, _ = serve(t, RequestID(okHandler), "GET / HTTP/1.1\r\nX-Request-Id: abc\r\n\r\n")
+	assert.Contains(t, res, "X-Request-Id: abc\r\n")
+
+	// test: each request gets its own id
+	_, _, other := serve(t, RequestID(okHandler), "GET / HTTP/1.1\r\n\r\n")
+	otherID, ok := other.Headers.Get(RequestIDHeader)
+	require.True(t, ok)
+	assert.NotEqual(t, id, otherID)
+}
+
+func TestTiming(t *testing.T) {
+	logs := captureLogs(t)
+
+	// test: duration is logged after the handler returns
+	serve(t, Timing(okHandler), "GET /cats HTTP/1.1\r\n\r\n")
+	assert.Contains(t, logs.String(), "GET /cats took ")
+}
+
+func TestRecoverServer(t *testing.T) {
+	captureLogs(t)
+
+	s, err := server.Serve(0, server.Chain(func(w *response.Writer, r *request.Request) {
+		w.Write([]byte(strings.Repeat("a", 5000)))
+		panic("boom")
+	}, Recover))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	// test: a chunked response cut short by a panic isn't finished by the server
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	_, err = io.ReadAll(res.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,45 @@
+package request
+
+import (
+	"errors"
+	"net"
+)
+
+// status codes the parser can fail with, kept here so request doesn't depend on response
+const (
+	statusBadRequest                  = 400
+	statusRequestTimeout              = 408
+	statusContentTooLarge             = 413
+	statusURITooLong                  = 414
+	statusExpectationFailed           = 417
+	statusRequestHeaderFieldsTooLarge = 431
+	statusNotImplemented              = 501
+	statusHTTPVersionNotSupported     = 505
+)
+
+// a request the parser rejected, along with the status code the server should respond with
+type ProtocolError struct {
+	StatusCode int
+	Err        error
+}
+
+func protocolError(statusCode int, err error) *ProtocolError {
+	return &ProtocolError{
+		StatusCode: statusCode,
+		Err:        err,
+	}
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// connection deadlines surface as timeouts from the underlying reader
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
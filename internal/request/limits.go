@@ -0,0 +1,41 @@
+package request
+
+// caps on how much of a request is accepted, enforced as bytes arrive rather than once the
+// request is fully buffered, zero fields fall back to the defaults
+type Limits struct {
+	// longest request line accepted before responding with 414
+	MaxRequestLineBytes int
+	// largest header section accepted before responding with 431, trailers are capped separately
+	MaxHeaderBytes int
+	// most field lines accepted before responding with 431
+	MaxHeaderCount int
+	// largest body accepted before responding with 413, chunked bodies are capped on their total size
+	MaxBodyBytes int
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 * 1024,
+	MaxHeaderBytes:      64 * 1024,
+	MaxHeaderCount:      100,
+	MaxBodyBytes:        10 * 1024 * 1024,
+}
+
+// chunk extensions are skipped, so there is no reason for a chunk size line to be long
+const maxChunkSizeLineBytes = 4 * 1024
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes <= 0 {
+		l.MaxRequestLineBytes = DefaultLimits.MaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = DefaultLimits.MaxBodyBytes
+	}
+
+	return l
+}
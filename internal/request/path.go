@@ -0,0 +1,74 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// how paths are normalized before routing, the zero value collapses repeated slashes and rejects
+// encoded ones
+type PathPolicy struct {
+	// keeps empty segments, for paths where /a//b and /a/b name different things
+	KeepDuplicateSlashes bool
+	// keeps %2F encoded in RawPath instead of rejecting the request, Path has it decoded so it
+	// can't be told apart from a real separator there
+	AllowEncodedSlashes bool
+}
+
+// removes . and .. segments as described in rfc 3986 section 5.2.4 and, unless the policy keeps
+// them, collapses repeated slashes, so handlers serving files can join the path onto a directory
+// without it escaping, the path is still percent encoded, segments are decoded only to check what
+// they are so %2e%2e counts as ..
+//
+// an encoded slash is rejected unless the policy allows it, once decoded it can't be told apart
+// from a real one, neither can a NUL which ends the path early for anything written in c
+func cleanPath(rawPath string, policy PathPolicy) (string, error) {
+	sent := strings.Split(strings.TrimPrefix(rawPath, "/"), "/")
+	segments := []string{}
+	// a path ending in a slash, . or .. names a directory, which is kept
+	trailingSlash := false
+	for i, segment := range sent {
+		decoded, err := unescape(segment, false)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(decoded, "\x00") {
+			return "", fmt.Errorf("encoded nul in path %q", rawPath)
+		}
+		if strings.Contains(decoded, "/") {
+			if !policy.AllowEncodedSlashes {
+				return "", fmt.Errorf("encoded slash in path %q", rawPath)
+			}
+			// the decoded path would otherwise have dot segments hidden in it
+			for part := range strings.SplitSeq(decoded, "/") {
+				if part == "." || part == ".." {
+					return "", fmt.Errorf("dot segment behind an encoded slash in path %q", rawPath)
+				}
+			}
+		}
+
+		trailingSlash = true
+		switch decoded {
+		case "":
+			// the last segment is empty when the path ends in a slash, not a repeated one
+			if policy.KeepDuplicateSlashes && i < len(sent)-1 {
+				segments = append(segments, segment)
+			}
+		case ".":
+		case "..":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+		default:
+			segments = append(segments, segment)
+			trailingSlash = false
+		}
+	}
+
+	path := "/" + strings.Join(segments, "/")
+	if trailingSlash && len(segments) > 0 {
+		path += "/"
+	}
+
+	return path, nil
+}
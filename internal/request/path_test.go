@@ -0,0 +1,163 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		rawPath  string
+		expected string
+	}{
+		// test: canonical paths are left alone
+		{rawPath: "/", expected: "/"},
+		{rawPath: "/image", expected: "/image"},
+		{rawPath: "/images/", expected: "/images/"},
+		{rawPath: "/cat%20photo.png", expected: "/cat%20photo.png"},
+		// test: dot segments are removed
+		{rawPath: "/./image", expected: "/image"},
+		{rawPath: "/a/../image", expected: "/image"},
+		{rawPath: "/a/b/..", expected: "/a/"},
+		{rawPath: "/a/.", expected: "/a/"},
+		{rawPath: "/..", expected: "/"},
+		// test: dot segments can't climb above the root
+		{rawPath: "/../../etc/passwd", expected: "/etc/passwd"},
+		{rawPath: "/a/../../etc/passwd", expected: "/etc/passwd"},
+		// test: encoded dots count as dot segments
+		{rawPath: "/%2e%2e/%2E%2e/etc/passwd", expected: "/etc/passwd"},
+		{rawPath: "/a/.%2e/image", expected: "/image"},
+		{rawPath: "/%2e/image", expected: "/image"},
+		// test: dots inside a name aren't segments
+		{rawPath: "/..image/a..", expected: "/..image/a.."},
+		// test: repeated slashes are collapsed
+		{rawPath: "//image", expected: "/image"},
+		{rawPath: "/a///b//", expected: "/a/b/"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.rawPath, func(t *testing.T) {
+			path, err := cleanPath(tc.rawPath, PathPolicy{})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, path)
+		})
+	}
+
+	// test: encoded slashes and nul are rejected
+	for _, rawPath := range []string{"/a%2fb", "/..%2F..%2Fetc/passwd", "/image%00.png", "/a/%zz"} {
+		_, err := cleanPath(rawPath, PathPolicy{})
+		require.Error(t, err, rawPath)
+	}
+}
+
+func TestPathPolicy(t *testing.T) {
+	// test: repeated slashes kept, dot segments still removed
+	keep := PathPolicy{KeepDuplicateSlashes: true}
+	for rawPath, expected := range map[string]string{
+		"//image":      "//image",
+		"/a//b/":       "/a//b/",
+		"/a//":         "/a//",
+		"/a//..":       "/a/",
+		"/./a/../b//c": "/b//c",
+		"/":            "/",
+	} {
+		path, err := cleanPath(rawPath, keep)
+		require.NoError(t, err, rawPath)
+		assert.Equal(t, expected, path, rawPath)
+	}
+
+	// test: encoded slashes kept encoded
+	allow := PathPolicy{AllowEncodedSlashes: true}
+	path, err := cleanPath("/repos/a%2Fb/./issues", allow)
+	require.NoError(t, err)
+	assert.Equal(t, "/repos/a%2Fb/issues", path)
+
+	// test: but not when they hide dot segments or nul
+	for _, rawPath := range []string{"/..%2F..%2Fetc/passwd", "/a%2F.", "/a%2F%2e%2e", "/a%2F%00"} {
+		_, err := cleanPath(rawPath, allow)
+		require.Error(t, err, rawPath)
+	}
+
+	// test: the policy reaches the parser through the reader
+	rd := NewReader(&chunkReader{
+		data:            "GET /repos/a%2Fb//issues HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	rd.SetPathPolicy(PathPolicy{KeepDuplicateSlashes: true, AllowEncodedSlashes: true})
+	r, err := rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/repos/a%2Fb//issues", r.URL.RawPath)
+	assert.Equal(t, "/repos/a/b//issues", r.URL.Path)
+	assert.False(t, r.URL.Cleaned)
+}
+
+func TestPathNormalization(t *testing.T) {
+	// test: handlers get the decoded normalized path, the target keeps what was sent
+	r, err := RequestParser(&chunkReader{
+		data:            "GET /static/%2e%2e//images/./cat%20photo.png?size=small HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/images/cat photo.png", r.URL.Path)
+	assert.Equal(t, "/images/cat%20photo.png", r.URL.RawPath)
+	assert.Equal(t, "size=small", r.URL.RawQuery)
+	assert.True(t, r.URL.Cleaned)
+	assert.Equal(t, "/static/%2e%2e//images/./cat%20photo.png?size=small", r.RequestLine.RequestTarget)
+
+	// test: absolute form paths are normalized too
+	r, err = RequestParser(&chunkReader{
+		data:            "GET http://localhost/a/../image HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/image", r.URL.Path)
+	assert.True(t, r.URL.Cleaned)
+
+	// test: an encoded slash is a bad request
+	_, err = RequestParser(&chunkReader{
+		data:            "GET /images%2F..%2F..%2Fsecret HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	requireStatus(t, err, 400)
+}
+
+func FuzzCleanPath(f *testing.F) {
+	for _, seed := range []string{"/", "/image", "/./a/../b", "//a//", "/%2e%2e/x", "/a%2fb", "/.%2E./..."} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, rawPath string) {
+		path, err := cleanPath("/"+rawPath, PathPolicy{})
+		if err != nil {
+			return
+		}
+
+		// whatever comes out has to be safe to join onto a directory
+		decoded, err := unescape(path, false)
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(decoded, "/"))
+		assert.NotContains(t, decoded, "//")
+		for segment := range strings.SplitSeq(decoded, "/") {
+			assert.NotEqual(t, ".", segment)
+			assert.NotEqual(t, "..", segment)
+		}
+
+		// letting slashes through can't let dot segments through with them
+		loose, err := cleanPath("/"+rawPath, PathPolicy{KeepDuplicateSlashes: true, AllowEncodedSlashes: true})
+		require.NoError(t, err)
+		decoded, err = unescape(loose, false)
+		require.NoError(t, err)
+		for segment := range strings.SplitSeq(decoded, "/") {
+			assert.NotEqual(t, ".", segment)
+			assert.NotEqual(t, "..", segment)
+		}
+
+		// cleaning is idempotent
+		again, err := cleanPath(path, PathPolicy{})
+		require.NoError(t, err)
+		assert.Equal(t, path, again)
+	})
+}
@@ -0,0 +1,266 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/junwei890/http-1.1/internal/headers"
+)
+
+// reads requests off a connection one after another, bytes belonging to the next request are
+// kept between calls so pipelined requests are not lost
+type Reader struct {
+	reader  io.Reader
+	buffer  []byte
+	read    int
+	limits  Limits
+	paths   PathPolicy
+	current *Request
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, DefaultLimits)
+}
+
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buffer: make([]byte, 1024),
+		limits: limits.withDefaults(),
+	}
+}
+
+// changes how the paths of requests read after this are normalized
+func (rd *Reader) SetPathPolicy(policy PathPolicy) {
+	rd.paths = policy
+}
+
+// reads more bytes from the connection into the section after unparsed bytes
+func (rd *Reader) fill() error {
+	// if there is the case of multiple reads without parsing and the buffer is full
+	if rd.read >= len(rd.buffer) {
+		newBuffer := make([]byte, len(rd.buffer)*2)
+		copy(newBuffer, rd.buffer)
+		rd.buffer = newBuffer
+	}
+
+	bytesRead, err := rd.reader.Read(rd.buffer[rd.read:])
+	rd.read += bytesRead
+	if bytesRead > 0 {
+		// parse what came with the error before giving up, the next read returns it again
+		return nil
+	}
+
+	return err
+}
+
+// cleans consumed bytes from the front of the buffer
+func (rd *Reader) consume(n int) {
+	copy(rd.buffer, rd.buffer[n:rd.read])
+	rd.read -= n
+}
+
+// parses buffered bytes into the request, returns the number of bytes parsed
+func (rd *Reader) parse(req *Request) (int, error) {
+	bytesParsed, err := req.parse(rd.buffer[:rd.read])
+	if err != nil {
+		return 0, err
+	}
+	rd.consume(bytesParsed)
+
+	return bytesParsed, nil
+}
+
+// whatever the handler left unread of the previous body is drained before the next request
+func (rd *Reader) drainCurrent() error {
+	if rd.current == nil {
+		return nil
+	}
+
+	if err := rd.current.Body.Close(); err != nil {
+		return err
+	}
+	rd.current = nil
+
+	return nil
+}
+
+// blocks until the first bytes of the next request are buffered, so time spent idle between
+// requests can be told apart from time spent sending one
+func (rd *Reader) WaitForRequest() error {
+	if err := rd.drainCurrent(); err != nil {
+		return err
+	}
+
+	for rd.read == 0 {
+		if err := rd.fill(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns once the request line and headers are parsed, the body is read through Request.Body
+func (rd *Reader) ReadRequest() (*Request, error) {
+	if err := rd.drainCurrent(); err != nil {
+		return nil, err
+	}
+
+	req := &Request{
+		state:    parsingRequestLine,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		limits:   rd.limits,
+		paths:    rd.paths,
+	}
+
+	for {
+		// leftover bytes from the previous request are parsed before reading more
+		if _, err := rd.parse(req); err != nil {
+			return nil, err
+		}
+
+		if req.state != parsingRequestLine && req.state != parsingHeaders {
+			req.Body = &body{
+				req:    req,
+				reader: rd,
+			}
+			rd.current = req
+
+			return req, nil
+		}
+
+		if err := rd.fill(); err != nil {
+			// client closed the connection or went idle before sending anything, no request to speak of
+			if req.state == parsingRequestLine && rd.read == 0 {
+				return nil, err
+			}
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("eof hit before the full request was received")
+			}
+			if isTimeout(err) {
+				return nil, protocolError(statusRequestTimeout, err)
+			}
+			return nil, err
+		}
+	}
+}
+
+// parses a single request and buffers its entire body, anything read past the end of it is discarded
+func RequestParser(reader io.Reader) (*Request, error) {
+	req, err := NewReader(reader).ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return req, nil
+}
+
+// enforces content length or chunk framing while pulling body bytes from the connection
+type body struct {
+	req    *Request
+	reader *Reader
+	closed bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fmt.Errorf("read on closed body")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, rd := b.req, b.reader
+	// the body won't arrive until the client is told to send it
+	if req.ExpectsContinue() {
+		req.expectContinue = false
+		if req.sendContinue != nil {
+			if err := req.sendContinue(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for {
+		switch req.state {
+		case parsingDone:
+			return 0, io.EOF
+		case parsingBodyData, parsingChunkData:
+			if rd.read == 0 {
+				if err := rd.fill(); err != nil {
+					return 0, bodyError(err)
+				}
+				continue
+			}
+
+			// only take what is left of the body or chunk, the rest is framing or the next request
+			n := copy(p, rd.buffer[:min(rd.read, req.remaining)])
+			rd.consume(n)
+			req.remaining -= n
+			req.bodyLength += n
+			if req.remaining == 0 {
+				if req.state == parsingBodyData {
+					req.state = parsingDone
+				} else {
+					req.state = parsingChunkEnd
+				}
+			}
+
+			return n, nil
+		default:
+			// framing such as chunk sizes and trailers are parsed until body data is reached
+			state := req.state
+			n, err := rd.parse(req)
+			if err != nil {
+				return 0, err
+			}
+			if n > 0 || req.state != state {
+				continue
+			}
+
+			if err := rd.fill(); err != nil {
+				return 0, bodyError(err)
+			}
+		}
+	}
+}
+
+func bodyError(err error) error {
+	// for when content length specified is larger than length of body received, or chunks are missing
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	if isTimeout(err) {
+		return protocolError(statusRequestTimeout, err)
+	}
+
+	return err
+}
+
+// drains whatever is left of the body so the next request on the connection can be read
+func (b *body) Close() error {
+	// asking for a body only to throw it away is pointless, the client may still send it without
+	// being asked though, so the connection can't be reused
+	if b.req.ExpectsContinue() {
+		b.closed = true
+		return fmt.Errorf("body was never asked for with a 100 continue")
+	}
+	if b.closed {
+		return nil
+	}
+
+	_, err := io.Copy(io.Discard, b)
+	b.closed = true
+
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -24,15 +25,37 @@ const (
 	parsingRequestLine parserState = "request line"
 	parsingHeaders     parserState = "headers"
 	parsingBody        parserState = "body"
+	parsingBodyData    parserState = "body data"
+	parsingChunkSize   parserState = "chunk size"
+	parsingChunkData   parserState = "chunk data"
+	parsingChunkEnd    parserState = "chunk end"
+	parsingTrailers    parserState = "trailers"
 	parsingDone        parserState = "done"
 )
 
 type Request struct {
 	RequestLine RequestLine
-	Headers     headers.Headers
-	Body        []byte
+	// the request target broken down, RequestLine keeps it as it was sent
+	URL     *URL
+	Headers *headers.Headers
+	// pulls from the connection on demand, the request is handed over once headers are parsed
+	Body io.ReadCloser
+	// only populated once the chunked body has been read till eof
+	Trailers *headers.Headers
+	// captured from the request target by a router
+	pathValues map[string]string
+	// the client holds the body back until it is told to go ahead with a 100 continue
+	expectContinue bool
+	sendContinue   func() error
+	limits         Limits
+	paths          PathPolicy
+	// counted separately for headers and trailers
+	headerBytes int
+	headerCount int
 	bodyLength  int
-	state       parserState
+	// bytes left in the current chunk or content length specified
+	remaining int
+	state     parserState
 }
 
 var validMethods map[string]struct{} = map[string]struct{}{
@@ -47,6 +70,8 @@ var validMethods map[string]struct{} = map[string]struct{}{
 	"TRACE":   {},
 }
 
+var methodRegex = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+\-.^_` + "`" + `|~]+$`)
+
 // only parses when it receives the entire request line
 func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	i := bytes.Index(data, []byte("\r\n"))
@@ -59,20 +84,20 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	// all 3 parts of a request line are required
 	requestLineParts := strings.Split(requestLine, " ")
 	if len(requestLineParts) != 3 {
-		return nil, 0, fmt.Errorf("request line requires 3 parts, only have %d", len(requestLineParts))
+		return nil, 0, protocolError(statusBadRequest, fmt.Errorf("request line requires 3 parts, only have %d", len(requestLineParts)))
 	}
 
-	// formatting checks
-	if _, ok := validMethods[requestLineParts[0]]; !ok {
-		return nil, 0, fmt.Errorf("%s method not supported", requestLineParts[0])
+	// formatting checks, a well formed method we don't know of isn't the client's fault
+	if !methodRegex.MatchString(requestLineParts[0]) {
+		return nil, 0, protocolError(statusBadRequest, fmt.Errorf("%s is an invalid method", requestLineParts[0]))
 	}
-
-	if !strings.HasPrefix(requestLineParts[1], "/") {
-		return nil, 0, fmt.Errorf("%s is an invalid route", requestLineParts[1])
+	if _, ok := validMethods[requestLineParts[0]]; !ok {
+		return nil, 0, protocolError(statusNotImplemented, fmt.Errorf("%s method not supported", requestLineParts[0]))
 	}
 
-	if requestLineParts[2] != "HTTP/1.1" {
-		return nil, 0, fmt.Errorf("%s is an unsupported protocol or version", requestLineParts[2])
+	// anything else in place of the version, newer or malformed, gets a 505
+	if requestLineParts[2] != "HTTP/1.1" && requestLineParts[2] != "HTTP/1.0" {
+		return nil, 0, protocolError(statusHTTPVersionNotSupported, fmt.Errorf("%s is an unsupported version", requestLineParts[2]))
 	}
 
 	return &RequestLine{
@@ -82,16 +107,203 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 	}, i + 2, nil
 }
 
+// transfer codings registered with iana, only chunked is decoded
+var knownCodings = map[string]struct{}{
+	"chunked":    {},
+	"compress":   {},
+	"deflate":    {},
+	"gzip":       {},
+	"x-compress": {},
+	"x-gzip":     {},
+}
+
+// checks the transfer codings of a request, chunked must be applied last and only once, otherwise
+// the end of the body can't be found and the rest of the connection can't be trusted
+func checkTransferEncoding(encoding string) error {
+	codings := []string{}
+	for coding := range strings.SplitSeq(encoding, ",") {
+		// empty list elements are allowed and ignored
+		if coding = strings.ToLower(strings.Trim(coding, " \t")); coding != "" {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 {
+		return protocolError(statusBadRequest, fmt.Errorf("empty transfer encoding"))
+	}
+
+	for _, coding := range codings {
+		if _, ok := knownCodings[coding]; !ok {
+			return protocolError(statusNotImplemented, fmt.Errorf("%s transfer coding not supported", coding))
+		}
+	}
+	if codings[len(codings)-1] != "chunked" {
+		return protocolError(statusBadRequest, fmt.Errorf("%s transfer encoding doesn't end with chunked", encoding))
+	}
+	if slices.Contains(codings[:len(codings)-1], "chunked") {
+		return protocolError(statusBadRequest, fmt.Errorf("%s transfer encoding applies chunked more than once", encoding))
+	}
+	// the other codings are known, but there is nothing to decode them with
+	if len(codings) > 1 {
+		return protocolError(statusNotImplemented, fmt.Errorf("%s transfer coding not supported", codings[0]))
+	}
+
+	return nil
+}
+
+// content length can be repeated, either as separate lines or a list, as long as every value is
+// the same, the value is digits only so signs and whitespace can't be read differently elsewhere
+func parseContentLength(values []string) (int, error) {
+	length := ""
+	for _, value := range values {
+		for part := range strings.SplitSeq(value, ",") {
+			part = strings.Trim(part, " \t")
+			if part == "" || strings.Trim(part, "0123456789") != "" {
+				return 0, protocolError(statusBadRequest, fmt.Errorf("%s not a valid content length", value))
+			}
+			if length != "" && strings.TrimLeft(part, "0") != strings.TrimLeft(length, "0") {
+				return 0, protocolError(statusBadRequest, fmt.Errorf("conflicting content lengths %s and %s", length, part))
+			}
+			length = part
+		}
+	}
+
+	lengthInt, err := strconv.Atoi(length)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, protocolError(statusContentTooLarge, fmt.Errorf("content length %s is too large", length))
+	}
+	if err != nil {
+		return 0, protocolError(statusBadRequest, fmt.Errorf("%s not a valid content length", length))
+	}
+
+	return lengthInt, nil
+}
+
+// only parses when it receives the entire chunk size line, chunk extensions are checked then ignored
+func parseChunkSize(data []byte) (int, int, error) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i == -1 {
+		return 0, 0, nil
+	}
+
+	line := string(data[:i])
+	// the size is every hex digit before the extensions
+	end := len(line) - len(strings.TrimLeft(line, "0123456789abcdefABCDEF"))
+	size, extensions := line[:end], line[end:]
+	// anything longer would overflow
+	if size == "" || len(size) > 15 {
+		return 0, 0, fmt.Errorf("%q is an invalid chunk size", line)
+	}
+	if err := checkChunkExtensions(extensions); err != nil {
+		return 0, 0, err
+	}
+
+	sizeInt, err := strconv.ParseInt(size, 16, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s is an invalid chunk size", size)
+	}
+
+	return int(sizeInt), i + 2, nil
+}
+
+// chunk extensions are ; separated names with an optional token or quoted string value, they are
+// ignored but still checked, a bare LF hidden in one is read as the end of the line by some proxies
+func checkChunkExtensions(extensions string) error {
+	for rest := extensions; rest != ""; {
+		// whitespace is allowed before each ; and around the =, nowhere else
+		rest = strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(rest, ";") {
+			return fmt.Errorf("%q is an invalid chunk extension", extensions)
+		}
+
+		var name string
+		name, rest = cutToken(strings.TrimLeft(rest[1:], " \t"))
+		if name == "" {
+			return fmt.Errorf("%q is an invalid chunk extension", extensions)
+		}
+
+		afterName := strings.TrimLeft(rest, " \t")
+		if !strings.HasPrefix(afterName, "=") {
+			continue
+		}
+
+		value := strings.TrimLeft(afterName[1:], " \t")
+		if strings.HasPrefix(value, `"`) {
+			var ok bool
+			if rest, ok = cutQuotedString(value); !ok {
+				return fmt.Errorf("%q is an invalid chunk extension", extensions)
+			}
+			continue
+		}
+		if value, rest = cutToken(value); value == "" {
+			return fmt.Errorf("%q is an invalid chunk extension", extensions)
+		}
+	}
+
+	return nil
+}
+
+// splits off the token at the start of s, empty if s doesn't start with one
+func cutToken(s string) (string, string) {
+	i := 0
+	for i < len(s) && (isAlpha(s[i]) || (s[i] >= '0' && s[i] <= '9') || strings.IndexByte("!#$%&'*+-.^_`|~", s[i]) != -1) {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+// skips past the quoted string at the start of s, a \ escapes the next character, control
+// characters other than tabs aren't allowed either way
+func cutQuotedString(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return "", false
+		}
+
+		switch c {
+		case '"':
+			return s[i+1:], true
+		case '\\':
+			i++
+			if i == len(s) || (s[i] < ' ' && s[i] != '\t') || s[i] == 0x7f {
+				return "", false
+			}
+		}
+	}
+
+	return "", false
+}
+
+// partial lines are counted too, so a client can't grow the buffer forever by never sending \r\n
+func (r *Request) checkHeaderLimits(data []byte, n int, done bool) error {
+	r.headerBytes += n
+	if r.headerBytes > r.limits.MaxHeaderBytes || (n == 0 && r.headerBytes+len(data) > r.limits.MaxHeaderBytes) {
+		return protocolError(statusRequestHeaderFieldsTooLarge, fmt.Errorf("%s longer than %d bytes", r.state, r.limits.MaxHeaderBytes))
+	}
+
+	if n > 0 && !done {
+		r.headerCount++
+	}
+	if r.headerCount > r.limits.MaxHeaderCount {
+		return protocolError(statusRequestHeaderFieldsTooLarge, fmt.Errorf("more than %d %s", r.limits.MaxHeaderCount, r.state))
+	}
+
+	return nil
+}
+
 func (r *Request) parse(data []byte) (int, error) {
 	bytesParsed := 0
 	for r.state != parsingDone {
+		state := r.state
 		n, err := r.parseHelper(data[bytesParsed:])
 		if err != nil {
 			return 0, err
 		}
 
 		bytesParsed += n
-		if n == 0 {
+		// nothing parsed and no change in state means more data is needed
+		if n == 0 && r.state == state {
 			break
 		}
 	}
@@ -106,11 +318,28 @@ func (r *Request) parseHelper(data []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		// partial lines are checked too, same as headers
+		lineLength := n - 2
+		if n == 0 {
+			lineLength = len(data)
+		}
+		if lineLength > r.limits.MaxRequestLineBytes {
+			return 0, protocolError(statusURITooLong, fmt.Errorf("request line longer than %d bytes", r.limits.MaxRequestLineBytes))
+		}
 		if n == 0 {
 			return 0, nil
 		}
 
+		url, err := parseURL(requestLine.RequestTarget, r.paths)
+		if err != nil {
+			return 0, protocolError(statusBadRequest, err)
+		}
+		if err := checkForm(requestLine.Method, url.Form); err != nil {
+			return 0, protocolError(statusBadRequest, err)
+		}
+
 		r.RequestLine = *requestLine
+		r.URL = url
 		r.state = parsingHeaders
 
 		return n, nil
@@ -118,36 +347,128 @@ func (r *Request) parseHelper(data []byte) (int, error) {
 		// unlike request line, headers are parsed one by one
 		n, done, err := r.Headers.Parse(data)
 		if err != nil {
+			return 0, protocolError(statusBadRequest, err)
+		}
+
+		if err := r.checkHeaderLimits(data, n, done); err != nil {
 			return 0, err
 		}
+
 		if done {
 			r.state = parsingBody
+			r.headerBytes = 0
+			r.headerCount = 0
 		}
 
 		return n, nil
 	case parsingBody:
-		// keeps adding to body until we reach eof or when entire body has been received
-		lengthString, err := r.Headers.Get("Content-Length")
+		// 100-continue is the only expectation defined, any other can't be met, http/1.0 clients
+		// don't know of expectations so theirs are ignored
+		if expect, ok := r.Headers.Get("Expect"); ok && r.RequestLine.HttpVersion != "1.0" {
+			if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+				return 0, protocolError(statusExpectationFailed, fmt.Errorf("%s expectation not supported", expect))
+			}
+			r.expectContinue = true
+		}
+
+		// a request with both could be framed differently by a proxy in front of the server, which
+		// would let a second request be smuggled inside the body of the first
+		if r.Headers.Has("Transfer-Encoding") && r.Headers.Has("Content-Length") {
+			return 0, protocolError(statusBadRequest, fmt.Errorf("both transfer encoding and content length specified"))
+		}
+
+		if encoding, ok := r.Headers.Get("Transfer-Encoding"); ok {
+			// transfer encoding didn't exist in http/1.0, so whatever sent it can't be trusted to
+			// agree on where the body ends
+			if r.RequestLine.HttpVersion == "1.0" {
+				return 0, protocolError(statusBadRequest, fmt.Errorf("transfer encoding in a http/1.0 request"))
+			}
+			if err := checkTransferEncoding(encoding); err != nil {
+				return 0, err
+			}
+
+			r.state = parsingChunkSize
+			return 0, nil
+		}
+
+		if !r.Headers.Has("Content-Length") {
+			// no body, anything after belongs to the next request
+			r.state = parsingDone
+			return 0, nil
+		}
+
+		lengthInt, err := parseContentLength(r.Headers.Values("Content-Length"))
 		if err != nil {
+			return 0, err
+		}
+		if lengthInt == 0 {
 			r.state = parsingDone
-			return len(data), nil
+			return 0, nil
 		}
+		// rejected before any of the body is transferred
+		if lengthInt > r.limits.MaxBodyBytes {
+			return 0, protocolError(statusContentTooLarge, fmt.Errorf("content length %d is larger than %d bytes", lengthInt, r.limits.MaxBodyBytes))
+		}
+
+		r.remaining = lengthInt
+		r.state = parsingBodyData
 
-		lengthInt, err := strconv.Atoi(lengthString)
+		return 0, nil
+	case parsingBodyData, parsingChunkData:
+		// body bytes are left for the body reader to pull
+		return 0, nil
+	case parsingChunkSize:
+		size, n, err := parseChunkSize(data)
 		if err != nil {
-			return 0, fmt.Errorf("%s not a valid content length", lengthString)
+			return 0, protocolError(statusBadRequest, err)
+		}
+		if n == 0 {
+			if len(data) > maxChunkSizeLineBytes {
+				return 0, protocolError(statusBadRequest, fmt.Errorf("chunk size line longer than %d bytes", maxChunkSizeLineBytes))
+			}
+			return 0, nil
+		}
+		// chunks already read count towards the limit, so the total size is capped
+		if r.bodyLength+size > r.limits.MaxBodyBytes {
+			return 0, protocolError(statusContentTooLarge, fmt.Errorf("chunked body larger than %d bytes", r.limits.MaxBodyBytes))
+		}
+
+		// a zero length chunk ends the body, trailers may follow
+		if size == 0 {
+			r.state = parsingTrailers
+			return n, nil
 		}
 
-		r.Body = slices.Concat(r.Body, data)
-		r.bodyLength += len(data)
-		if r.bodyLength > lengthInt {
-			return 0, fmt.Errorf("length of body: %d, is more than content length specified: %d", len(r.Body), lengthInt)
+		r.remaining = size
+		r.state = parsingChunkData
+
+		return n, nil
+	case parsingChunkEnd:
+		// chunk data is always terminated with \r\n
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if !bytes.HasPrefix(data, []byte("\r\n")) {
+			return 0, protocolError(statusBadRequest, fmt.Errorf("chunk data longer than chunk size specified"))
+		}
+
+		r.state = parsingChunkSize
+
+		return 2, nil
+	case parsingTrailers:
+		// trailers share the same format as headers
+		n, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, protocolError(statusBadRequest, err)
 		}
-		if r.bodyLength == lengthInt {
+		if err := r.checkHeaderLimits(data, n, done); err != nil {
+			return 0, err
+		}
+		if done {
 			r.state = parsingDone
 		}
 
-		return len(data), nil
+		return n, nil
 	case parsingDone:
 		return 0, fmt.Errorf("parsing in a done state")
 	default:
@@ -155,45 +476,45 @@ func (r *Request) parseHelper(data []byte) (int, error) {
 	}
 }
 
-func RequestParser(reader io.Reader) (*Request, error) {
-	buffer := make([]byte, 8)
-	read := 0
-	req := &Request{
-		state:   parsingRequestLine,
-		Headers: headers.NewHeaders(),
+// returns the path parameter captured under name, or an empty string if there isn't one
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = map[string]string{}
 	}
 
-	for req.state != parsingDone {
-		// if there is the case of multiple reads without parsing and the buffer is full
-		if read >= len(buffer) {
-			newBuffer := make([]byte, len(buffer)*2)
-			copy(newBuffer, buffer)
-			buffer = newBuffer
-		}
+	r.pathValues[name] = value
+}
 
-		// read into section after unparsed bytes
-		bytesRead, err := reader.Read(buffer[read:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if req.state != parsingDone {
-					// for when content length specified is larger than length of body received
-					return nil, fmt.Errorf("eof hit without receiving full content length specified")
-				}
-				break
-			}
-			return nil, err
-		}
-		read += bytesRead
+// reports whether the client is still waiting to be told to send the body, a handler can reject
+// the request without reading the body while this is true
+func (r *Request) ExpectsContinue() bool {
+	return r.expectContinue && r.state != parsingDone
+}
 
-		// try to parse the buffer
-		bytesParsed, err := req.parse(buffer[:read])
-		if err != nil {
-			return nil, err
+// send is called the first time the body is read while the client waits for a 100 continue
+func (r *Request) OnContinue(send func() error) {
+	r.sendContinue = send
+}
+
+// http/1.1 connections are persistent unless the client asks for it to be closed, http/1.0 ones
+// are closed unless the client asks for it to be kept alive
+func (r *Request) KeepAlive() bool {
+	keepAlive := r.RequestLine.HttpVersion != "1.0"
+
+	// connection is a comma separated list of options
+	connection, _ := r.Headers.Get("Connection")
+	for option := range strings.SplitSeq(connection, ",") {
+		switch strings.ToLower(strings.TrimSpace(option)) {
+		case "close":
+			return false
+		case "keep-alive":
+			keepAlive = true
 		}
-		// if anything is parsed, parsed bytes are cleaned
-		copy(buffer, buffer[bytesParsed:])
-		read -= bytesParsed
 	}
 
-	return req, nil
+	return keepAlive
 }
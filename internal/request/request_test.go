@@ -1,7 +1,10 @@
 package request
 
 import (
+	"errors"
 	"io"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/junwei890/http-1.1/internal/headers"
@@ -30,6 +33,20 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// value of the field, empty if there isn't one
+func get(h *headers.Headers, key string) string {
+	value, _ := h.Get(key)
+
+	return value
+}
+
+func readBody(t *testing.T, r *Request) string {
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+
+	return string(body)
+}
+
 func TestRequestLineHeaderParse(t *testing.T) {
 	// test: good get request line, no headers
 	reader := &chunkReader{
@@ -42,7 +59,7 @@ func TestRequestLineHeaderParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
-	assert.Equal(t, headers.Headers{}, r.Headers)
+	assert.Equal(t, 0, r.Headers.Len())
 
 	// test: good get request line, good headers
 	reader = &chunkReader{
@@ -55,13 +72,13 @@ func TestRequestLineHeaderParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// test: good get request line with path, good headers with whitespace
 	reader = &chunkReader{
-		data:            "GET /cats HTTP/1.1\r\n Host: localhost:42069 \r\n User-Agent: curl/7.81.0 \r\n Accept: */* \r\n\r\n",
+		data:            "GET /cats HTTP/1.1\r\nHost:  localhost:42069 \r\nUser-Agent: curl/7.81.0 \r\nAccept:\t*/* \r\n\r\n",
 		numBytesPerRead: 4,
 	}
 	r, err = RequestParser(reader)
@@ -70,13 +87,13 @@ func TestRequestLineHeaderParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/cats", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// test: good post request line with path, good headers with whitespace
 	reader = &chunkReader{
-		data:            "POST /cats HTTP/1.1\r\n Host: localhost:42069 \r\n User-Agent: curl/7.81.0 \r\n Accept: */* \r\n\r\n",
+		data:            "POST /cats HTTP/1.1\r\nHost:  localhost:42069 \r\nUser-Agent: curl/7.81.0 \r\nAccept:\t*/* \r\n\r\n",
 		numBytesPerRead: 8,
 	}
 	r, err = RequestParser(reader)
@@ -85,9 +102,9 @@ func TestRequestLineHeaderParse(t *testing.T) {
 	assert.Equal(t, "POST", r.RequestLine.Method)
 	assert.Equal(t, "/cats", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// test: good get request line with path, good duplicate headers
 	reader = &chunkReader{
@@ -100,8 +117,8 @@ func TestRequestLineHeaderParse(t *testing.T) {
 	assert.Equal(t, "GET", r.RequestLine.Method)
 	assert.Equal(t, "/cats", r.RequestLine.RequestTarget)
 	assert.Equal(t, "1.1", r.RequestLine.HttpVersion)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "application/json, text/html", r.Headers["content-type"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "application/json, text/html", get(r.Headers, "content-type"))
 
 	// test: invalid number of parts in request line
 	reader = &chunkReader{
@@ -153,8 +170,10 @@ func TestBodyParse(t *testing.T) {
 	r, err := RequestParser(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world\n", string(r.Body))
-	assert.Equal(t, 12, len(r.Body))
+	body, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(body))
+	assert.Equal(t, 12, len(body))
 
 	// test: empty body with no content length
 	reader = &chunkReader{
@@ -164,8 +183,10 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestParser(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
-	assert.Equal(t, 0, len(r.Body))
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+	assert.Equal(t, 0, len(body))
 
 	// test: empty body with content length
 	reader = &chunkReader{
@@ -175,8 +196,10 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestParser(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
-	assert.Equal(t, 0, len(r.Body))
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+	assert.Equal(t, 0, len(body))
 
 	// test: incomplete request
 	reader = &chunkReader{
@@ -194,6 +217,551 @@ func TestBodyParse(t *testing.T) {
 	r, err = RequestParser(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
-	assert.Equal(t, 0, len(r.Body))
+	body, err = io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "", string(body))
+	assert.Equal(t, 0, len(body))
+}
+
+func TestKeepAlive(t *testing.T) {
+	// test: persistent by default
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err := RequestParser(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// test: client asks for the connection to be closed
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: Close\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// test: close amongst other connection options
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: upgrade, close\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// test: explicit keep-alive
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nConnection: keep-alive\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// test: http/1.0 is closed by default
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// test: http/1.0 asks for the connection to be kept alive
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// test: connection closed before a request is sent
+	reader = &chunkReader{
+		data:            "",
+		numBytesPerRead: 8,
+	}
+	_, err = RequestParser(reader)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestPipelinedParse(t *testing.T) {
+	// test: requests sent back to back are read in order
+	reader := NewReader(&chunkReader{
+		data:            "GET /first HTTP/1.1\r\nHost: localhost:42069\r\n\r\nPOST /second HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 5\r\n\r\nhelloGET /third HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, io.EOF)
+
+	// test: whole pipeline delivered in a single read
+	reader = NewReader(&chunkReader{
+		data:            "GET /first HTTP/1.1\r\n\r\nGET /second HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 1024,
+	})
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// test: connection closed part way through the next request
+	reader = NewReader(&chunkReader{
+		data:            "GET /first HTTP/1.1\r\n\r\nGET /sec",
+		numBytesPerRead: 1024,
+	})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+
+	// test: negative content length
+	reader = NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+}
+
+func TestChunkedBodyParse(t *testing.T) {
+	// test: valid chunked body, one byte at a time
+	reader := &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7\r\n world\n\r\n0\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err := RequestParser(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world\n", readBody(t, r))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// test: hexadecimal chunk sizes and chunk extensions
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\n\r\na;name=value\r\n0123456789\r\n1 ; last\r\n!\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789!", readBody(t, r))
+
+	// test: trailers after the last chunk
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nHost: localhost:42069\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n5\r\nhello\r\n0\r\nX-Checksum: abc123\r\n\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestParser(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello", readBody(t, r))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+
+	// test: chunked request followed by a pipelined request
+	rd := NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\nGET / HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 2,
+	})
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "abc", readBody(t, r))
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/", r.RequestLine.RequestTarget)
+
+	// test: invalid chunk size
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	_, err = RequestParser(reader)
+	require.Error(t, err)
+
+	// test: signed chunk size
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	_, err = RequestParser(reader)
+	require.Error(t, err)
+
+	// test: chunk data longer than chunk size
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 8,
+	}
+	_, err = RequestParser(reader)
+	require.Error(t, err)
+
+	// test: connection closed before the last chunk
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+		numBytesPerRead: 8,
+	}
+	_, err = RequestParser(reader)
+	require.Error(t, err)
+
+	// test: unsupported transfer encoding
+	reader = &chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\nhello",
+		numBytesPerRead: 8,
+	}
+	_, err = RequestParser(reader)
+	require.Error(t, err)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// test: request is handed over before the body arrives
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("POST /upload HTTP/1.1\r\nContent-Length: 11\r\n\r\n"))
+		pw.Write([]byte("hello "))
+		pw.Write([]byte("world"))
+	}()
+	rd := NewReader(pr)
+	r, err := rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+
+	buffer := make([]byte, 64)
+	n, err := r.Body.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello ", string(buffer[:n]))
+	assert.Equal(t, "world", readBody(t, r))
+
+	// test: unread body is drained before the next request
+	rd = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\nPOST /next HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /last HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	require.NoError(t, r.Body.Close())
+
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/last", r.RequestLine.RequestTarget)
+
+	// test: read after close
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(buffer)
+	require.Error(t, err)
+
+	// test: body cut short by the connection
+	rd = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello",
+		numBytesPerRead: 4,
+	})
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestExpectContinue(t *testing.T) {
+	// test: 100 continue is sent once, on the first read of the body
+	rd := NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 4,
+	})
+	r, err := rd.ReadRequest()
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	sent := 0
+	r.OnContinue(func() error {
+		sent++
+		return nil
+	})
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, "hello", readBody(t, r))
+	assert.Equal(t, 1, sent)
+	assert.False(t, r.ExpectsContinue())
+
+	// test: nothing to wait for without a body
+	rd = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nExpect: 100-Continue\r\nContent-Length: 0\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+
+	// test: body that was never asked for can't be drained
+	rd = NewReader(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nExpect: 100-continue\r\nTransfer-Encoding: chunked\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	require.Error(t, r.Body.Close())
+	_, err = rd.ReadRequest()
+	require.Error(t, err)
+
+	// test: unknown expectation
+	_, err = RequestParser(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nExpect: 200-ok\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 4,
+	})
+	requireStatus(t, err, 417)
+
+	// test: body too large is rejected before the client is asked for it
+	_, err = NewReaderWithLimits(&chunkReader{
+		data:            "POST /upload HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n",
+		numBytesPerRead: 4,
+	}, Limits{MaxBodyBytes: 10}).ReadRequest()
+	requireStatus(t, err, 413)
+}
+
+// hands over its data then times out, like a connection past its read deadline
+type timeoutReader struct {
+	data string
+	done bool
+}
+
+func (tr *timeoutReader) Read(p []byte) (int, error) {
+	if tr.done {
+		return 0, os.ErrDeadlineExceeded
+	}
+	tr.done = true
+
+	return copy(p, tr.data), nil
+}
+
+func requireStatus(t *testing.T, err error, statusCode int) {
+	var protocolErr *ProtocolError
+	require.ErrorAs(t, err, &protocolErr)
+	assert.Equal(t, statusCode, protocolErr.StatusCode)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	// test: malformed request line
+	_, err := RequestParser(&chunkReader{
+		data:            "GET /cats\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 400)
+
+	// test: invalid characters in method
+	_, err = RequestParser(&chunkReader{
+		data:            "/cats GET HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 400)
+
+	// test: unknown method
+	_, err = RequestParser(&chunkReader{
+		data:            "BREW /pot HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 501)
+
+	// test: unsupported version
+	_, err = RequestParser(&chunkReader{
+		data:            "GET / HTTP/2.0\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 505)
+
+	// test: versions past 1.1 and malformed ones
+	for _, version := range []string{"HTTP/1", "HTTP/2", "HTTP/1.2", "HTTP/3.0", "HTTP/0.9", "HTTX/1.1", "HTTP/1.1.1", "HTTPS/1.1", "http/1.1", "HTTP/1.x", "HTTP/"} {
+		_, err = RequestParser(&chunkReader{
+			data:            "GET / " + version + "\r\n\r\n",
+			numBytesPerRead: 8,
+		})
+		requireStatus(t, err, 505)
+	}
+
+	// test: request line too long
+	_, err = RequestParser(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", DefaultLimits.MaxRequestLineBytes) + " HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 1024,
+	})
+	requireStatus(t, err, 414)
+
+	// test: headers too long
+	_, err = RequestParser(&chunkReader{
+		data:            "GET / HTTP/1.1\r\n" + strings.Repeat("X-Padding: aaaaaaaaaaaaaaaa\r\n", DefaultLimits.MaxHeaderBytes/16) + "\r\n",
+		numBytesPerRead: 1024,
+	})
+	requireStatus(t, err, 431)
+
+	// test: malformed header
+	_, err = RequestParser(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost : localhost\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 400)
+
+	// test: content length too large to represent
+	_, err = RequestParser(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 99999999999999999999999\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 413)
+
+	// test: unknown transfer encoding
+	_, err = RequestParser(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: br\r\n\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 501)
+
+	// test: invalid chunk size surfaces while reading the body
+	_, err = RequestParser(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n",
+		numBytesPerRead: 8,
+	})
+	requireStatus(t, err, 400)
+
+	// test: timeout part way through the request
+	_, err = RequestParser(&timeoutReader{
+		data: "GET / HTTP/1.1\r\nHost: local",
+	})
+	requireStatus(t, err, 408)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// test: timeout part way through the body
+	_, err = RequestParser(&timeoutReader{
+		data: "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello",
+	})
+	requireStatus(t, err, 408)
+
+	// test: timeout before anything was sent is not a protocol error
+	_, err = RequestParser(&timeoutReader{done: true})
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var protocolErr *ProtocolError
+	assert.False(t, errors.As(err, &protocolErr))
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        8,
+	}
+
+	// test: within every limit
+	r, err := NewReaderWithLimits(&chunkReader{
+		data:            "POST /cats HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8\r\n\r\n12345678",
+		numBytesPerRead: 1,
+	}, limits).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", readBody(t, r))
+
+	// test: request line that never ends
+	_, err = NewReaderWithLimits(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 64),
+		numBytesPerRead: 1,
+	}, limits).ReadRequest()
+	requireStatus(t, err, 414)
+
+	// test: single header line that never ends
+	_, err = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nX-Padding: " + strings.Repeat("a", 64),
+		numBytesPerRead: 4,
+	}, limits).ReadRequest()
+	requireStatus(t, err, 431)
+
+	// test: too many headers
+	_, err = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		numBytesPerRead: 4,
+	}, limits).ReadRequest()
+	requireStatus(t, err, 431)
+
+	// test: content length over the limit is rejected before the body is read
+	_, err = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n",
+		numBytesPerRead: 4,
+	}, limits).ReadRequest()
+	requireStatus(t, err, 413)
+
+	// test: chunked body over the limit in total
+	r, err = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 4,
+	}, limits).ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	requireStatus(t, err, 413)
+
+	// test: too many trailers
+	r, err = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		numBytesPerRead: 4,
+	}, limits).ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	requireStatus(t, err, 431)
+
+	// test: chunk size line that never ends
+	r, err = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;" + strings.Repeat("a", 8*1024),
+		numBytesPerRead: 512,
+	}, limits).ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.Body)
+	requireStatus(t, err, 400)
+
+	// test: zero values fall back to the defaults
+	r, err = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 4,
+	}, Limits{}).ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultLimits, r.limits)
+}
+
+func TestHTTP10(t *testing.T) {
+	// test: body framed by content length
+	r, err := RequestParser(&chunkReader{
+		data:            "POST /upload HTTP/1.0\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// test: expectations are ignored, the body is sent without waiting
+	r, err = RequestParser(&chunkReader{
+		data:            "POST /upload HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// test: transfer encoding didn't exist yet
+	_, err = RequestParser(&chunkReader{
+		data:            "POST /upload HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	requireStatus(t, err, 400)
 }
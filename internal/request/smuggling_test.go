@@ -0,0 +1,142 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requests that a proxy and this parser could disagree on the length of, each must be rejected
+// before any of the body is treated as the start of another request
+func TestSmuggling(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		statusCode int
+	}{
+		// test: content length and transfer encoding together, in either order
+		{name: "cl.te", data: "POST / HTTP/1.1\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG", statusCode: 400},
+		{name: "te.cl", data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n", statusCode: 400},
+		{name: "cl.te with empty length", data: "POST / HTTP/1.1\r\nContent-Length:\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", statusCode: 400},
+
+		// test: content lengths that disagree
+		{name: "differing lines", data: "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 10\r\n\r\nhello", statusCode: 400},
+		{name: "differing list", data: "POST / HTTP/1.1\r\nContent-Length: 5, 10\r\n\r\nhello", statusCode: 400},
+
+		// test: content lengths another parser might read differently
+		{name: "plus sign", data: "POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\nhello", statusCode: 400},
+		{name: "minus sign", data: "POST / HTTP/1.1\r\nContent-Length: -5\r\n\r\nhello", statusCode: 400},
+		{name: "hex", data: "POST / HTTP/1.1\r\nContent-Length: 0x5\r\n\r\nhello", statusCode: 400},
+		{name: "inner space", data: "POST / HTTP/1.1\r\nContent-Length: 1 0\r\n\r\nhello", statusCode: 400},
+		{name: "empty", data: "POST / HTTP/1.1\r\nContent-Length:\r\n\r\nhello", statusCode: 400},
+		{name: "trailing list element", data: "POST / HTTP/1.1\r\nContent-Length: 5,\r\n\r\nhello", statusCode: 400},
+		{name: "overflow", data: "POST / HTTP/1.1\r\nContent-Length: 99999999999999999999\r\n\r\nhello", statusCode: 413},
+
+		// test: transfer encodings where chunked isn't the final coding
+		{name: "not chunked", data: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\nhello", statusCode: 400},
+		{name: "chunked first", data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n", statusCode: 400},
+		{name: "chunked twice", data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", statusCode: 400},
+		{name: "chunked twice over lines", data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", statusCode: 400},
+		{name: "empty encoding", data: "POST / HTTP/1.1\r\nTransfer-Encoding: ,\r\n\r\n0\r\n\r\n", statusCode: 400},
+
+		// test: transfer codings that can't be decoded
+		{name: "unknown coding", data: "POST / HTTP/1.1\r\nTransfer-Encoding: br\r\n\r\n0\r\n\r\n", statusCode: 501},
+		{name: "unknown coding before chunked", data: "POST / HTTP/1.1\r\nTransfer-Encoding: xchunked, chunked\r\n\r\n0\r\n\r\n", statusCode: 501},
+		{name: "lookalike", data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked-false\r\n\r\n0\r\n\r\n", statusCode: 501},
+		{name: "coding with parameters", data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked;q=1\r\n\r\n0\r\n\r\n", statusCode: 501},
+		{name: "known coding before chunked", data: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", statusCode: 501},
+
+		// test: framing headers hidden from other parsers
+		{name: "space before colon", data: "POST / HTTP/1.1\r\nTransfer-Encoding : chunked\r\nContent-Length: 5\r\n\r\nhello", statusCode: 400},
+		{name: "folded encoding", data: "POST / HTTP/1.1\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n", statusCode: 400},
+		{name: "bare lf in value", data: "POST / HTTP/1.1\r\nX-Test: a\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\nhello", statusCode: 400},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rd := NewReader(&chunkReader{
+				data:            tc.data,
+				numBytesPerRead: 7,
+			})
+			_, err := rd.ReadRequest()
+			requireStatus(t, err, tc.statusCode)
+		})
+	}
+}
+
+func TestFraming(t *testing.T) {
+	// test: repeated content lengths that agree are fine
+	r, err := RequestParser(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 05, 5\r\n\r\nhello",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// test: codings are case insensitive and empty list elements are ignored
+	r, err = RequestParser(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: , CHUNKED\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	// test: the request after a body is only parsed where the body ends
+	rd := NewReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhelloGET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readBody(t, r))
+	r, err = rd.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+// chunk extensions are ignored, but a proxy in front could end the chunk size line somewhere else
+func TestChunkExtensions(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		// test: line endings and control characters hidden in an extension
+		{name: "bare lf", line: "5;a\nb"},
+		{name: "bare cr", line: "5;a\rb"},
+		{name: "nul", line: "5;a\x00"},
+		{name: "lf in quoted value", line: "5;a=\"b\nc\""},
+		{name: "escaped lf", line: "5;a=\"b\\\n\""},
+		// test: whitespace anywhere but before ; or around =
+		{name: "trailing space", line: "5 "},
+		{name: "trailing tab", line: "5\t"},
+		{name: "space after extension", line: "5;a=b "},
+		{name: "space inside size", line: "5 5"},
+		// test: extensions that aren't name=value pairs
+		{name: "empty name", line: "5;"},
+		{name: "empty value", line: "5;a="},
+		{name: "separator in name", line: "5;a/b"},
+		{name: "unterminated quote", line: "5;a=\"b"},
+		{name: "missing separator", line: "5;a=b c"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := RequestParser(&chunkReader{
+				data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + tc.line + "\r\nhello\r\n0\r\n\r\n",
+				numBytesPerRead: 7,
+			})
+			requireStatus(t, err, 400)
+		})
+	}
+
+	// test: tokens, quoted strings and whitespace where it is allowed
+	for _, line := range []string{"5;a", "5 ;a", "5\t; a = b", "5;a=b;c", "5;a=\"b c;\\\"d\"", "5;a=\"\";b=c"} {
+		r, err := RequestParser(&chunkReader{
+			data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + line + "\r\nhello\r\n0\r\n\r\n",
+			numBytesPerRead: 7,
+		})
+		require.NoError(t, err, line)
+		assert.Equal(t, "hello", readBody(t, r))
+	}
+}
@@ -0,0 +1,239 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+type TargetForm string
+
+// the 4 ways a request target can be written
+const (
+	// /path?query, what requests sent straight to the server use
+	OriginForm TargetForm = "origin"
+	// http://host/path?query, what requests sent through a proxy use
+	AbsoluteForm TargetForm = "absolute"
+	// host:port, only used by CONNECT to open a tunnel
+	AuthorityForm TargetForm = "authority"
+	// *, only used by OPTIONS to ask about the server as a whole
+	AsteriskForm TargetForm = "asterisk"
+)
+
+// the request target split into its parts, fragments are never sent so there is no field for one
+type URL struct {
+	Form TargetForm
+	// lowercased, only set for absolute form
+	Scheme string
+	// host and optional port, only set for absolute and authority form, see the Host header otherwise
+	Host string
+	// percent decoded and normalized, used for routing, empty for authority form and * for asterisk form
+	Path string
+	// normalized but still percent encoded, RequestLine.RequestTarget has the path as it was sent
+	RawPath string
+	// whether the path sent had dot segments or repeated slashes that normalizing removed
+	Cleaned bool
+	// everything after the ?, still percent encoded
+	RawQuery string
+}
+
+// query parameters, a key can be repeated so each one maps to every value it was sent with
+type Values map[string][]string
+
+// first value of the key, or an empty string if it wasn't sent
+func (v Values) Get(key string) string {
+	if len(v[key]) == 0 {
+		return ""
+	}
+
+	return v[key][0]
+}
+
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
+// only visible ascii is allowed in a request target, anything else has to be percent encoded,
+// # starts a fragment which clients must not send
+func parseURL(target string, policy PathPolicy) (*URL, error) {
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		if c <= ' ' || c >= 0x7f || c == '#' {
+			return nil, fmt.Errorf("invalid character %q in request target %q", c, target)
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(target, "/"):
+		return parsePathAndQuery(OriginForm, target, policy)
+	case target == "*":
+		return &URL{
+			Form:    AsteriskForm,
+			Path:    "*",
+			RawPath: "*",
+		}, nil
+	case strings.Contains(target, "://"):
+		return parseAbsoluteForm(target, policy)
+	default:
+		// anything else has to be a host and port
+		if err := checkAuthority(target, true); err != nil {
+			return nil, err
+		}
+
+		return &URL{
+			Form: AuthorityForm,
+			Host: target,
+		}, nil
+	}
+}
+
+// scheme://authority followed by an optional path and query
+func parseAbsoluteForm(target string, policy PathPolicy) (*URL, error) {
+	scheme, rest, _ := strings.Cut(target, "://")
+	if scheme == "" || !isAlpha(scheme[0]) || strings.Trim(strings.ToLower(scheme), "abcdefghijklmnopqrstuvwxyz0123456789+-.") != "" {
+		return nil, fmt.Errorf("%q is an invalid scheme", scheme)
+	}
+
+	host, pathAndQuery := rest, "/"
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		host, pathAndQuery = rest[:i], rest[i:]
+		// an empty path is the same as /
+		if pathAndQuery[0] == '?' {
+			pathAndQuery = "/" + pathAndQuery
+		}
+	}
+	if err := checkAuthority(host, false); err != nil {
+		return nil, err
+	}
+
+	u, err := parsePathAndQuery(AbsoluteForm, pathAndQuery, policy)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.ToLower(scheme)
+	u.Host = host
+
+	return u, nil
+}
+
+// a host with an optional port, credentials aren't allowed since they would end up in logs
+func checkAuthority(authority string, portRequired bool) error {
+	if strings.Contains(authority, "@") {
+		return fmt.Errorf("credentials in request target %q", authority)
+	}
+
+	host, port := authority, ""
+	// ip v6 addresses are wrapped in brackets since they contain colons themselves
+	if i := strings.LastIndex(authority, ":"); i != -1 && !strings.Contains(authority[i:], "]") {
+		host, port = authority[:i], authority[i+1:]
+		if port == "" || strings.Trim(port, "0123456789") != "" {
+			return fmt.Errorf("%q is an invalid port in request target", port)
+		}
+	} else if portRequired {
+		return fmt.Errorf("request target %q needs a port", authority)
+	}
+	if host == "" || strings.ContainsAny(host, "/?") {
+		return fmt.Errorf("%q is an invalid host in request target", host)
+	}
+
+	return nil
+}
+
+func parsePathAndQuery(form TargetForm, target string, policy PathPolicy) (*URL, error) {
+	sentPath, rawQuery, _ := strings.Cut(target, "?")
+	rawPath, err := cleanPath(sentPath, policy)
+	if err != nil {
+		return nil, err
+	}
+	// escapes were checked while cleaning
+	path, _ := unescape(rawPath, false)
+	// escapes in the query are checked here, so Query can't fail later
+	if _, err := unescape(rawQuery, true); err != nil {
+		return nil, err
+	}
+
+	return &URL{
+		Form:     form,
+		Path:     path,
+		RawPath:  rawPath,
+		Cleaned:  rawPath != sentPath,
+		RawQuery: rawQuery,
+	}, nil
+}
+
+// CONNECT is the only method with a host and port as the target, and OPTIONS the only one with *
+func checkForm(method string, form TargetForm) error {
+	if method == "CONNECT" && form != AuthorityForm {
+		return fmt.Errorf("CONNECT needs a host and port as the request target")
+	}
+	if form == AuthorityForm && method != "CONNECT" {
+		return fmt.Errorf("%s can't have a host and port as the request target", method)
+	}
+	if form == AsteriskForm && method != "OPTIONS" {
+		return fmt.Errorf("%s can't have * as the request target", method)
+	}
+
+	return nil
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// decodes %XX escapes, a + is only a space in the query
+func unescape(s string, plusIsSpace bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", fmt.Errorf("invalid escape %q in request target", s[i:min(i+3, len(s))])
+			}
+			builder.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case s[i] == '+' && plusIsSpace:
+			builder.WriteByte(' ')
+		default:
+			builder.WriteByte(s[i])
+		}
+	}
+
+	return builder.String(), nil
+}
+
+func isHex(c byte) bool {
+	return strings.IndexByte("0123456789abcdefABCDEF", c) != -1
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	default:
+		return c - '0'
+	}
+}
+
+// parses the query on every call, pairs are separated by & and a key without = has an empty value
+func (u *URL) Query() Values {
+	values := Values{}
+	for pair := range strings.SplitSeq(u.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(pair, "=")
+		// escapes were already checked when the target was parsed
+		key, _ = unescape(key, true)
+		value, _ = unescape(value, true)
+		values[key] = append(values[key], value)
+	}
+
+	return values
+}
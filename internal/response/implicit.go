@@ -0,0 +1,149 @@
+package response
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/junwei890/http-1.1/internal/headers"
+)
+
+// bodies up to this size are sent with a content length, anything larger is sent in chunks
+const pendingLimit = 4 * 1024
+
+// sets the status code the response is sent with, 200 is used if it is never called
+// only the first call counts, and none count after the first Write, an invalid or 1xx code is a
+// bug in the handler so the response goes out as a 500 instead of not at all, 1xx responses are
+// sent with WriteInterim
+func (w *Writer) WriteHeader(statusCode StatusCode) {
+	if w.status != 0 || w.state != writingStatusLine {
+		return
+	}
+	if !validStatus(statusCode) || statusCode < 200 {
+		statusCode = StatusInternalServerError
+	}
+
+	w.status = statusCode
+}
+
+// writes to the body, the status line and Header() are sent implicitly before the first bytes go out
+// small bodies are held back so the content length can be set, larger ones switch to chunked encoding
+func (w *Writer) Write(p []byte) (int, error) {
+	switch w.state {
+	case writingStatusLine, writingHeaders:
+		if w.status == 0 {
+			w.status = StatusOK
+		}
+		if len(p) > 0 && bodyForbidden(w.status) {
+			return 0, fmt.Errorf("%d responses can't have a body", w.status)
+		}
+
+		// a HEAD response only needs the length of the body
+		if w.suppressBody && !w.header.Has("Content-Length") {
+			w.suppressed += len(p)
+			return len(p), nil
+		}
+
+		// a content length set by the handler means the body can be streamed as is
+		if len(w.pending)+len(p) <= pendingLimit && !w.header.Has("Content-Length") {
+			w.pending = append(w.pending, p...)
+			return len(p), nil
+		}
+
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+
+		return w.Write(p)
+	case writingBody:
+		return w.WriteBody(p)
+	case writingChunks:
+		return w.WriteChunkedBody(p)
+	default:
+		return 0, w.expect("body", writingBody)
+	}
+}
+
+// sends the status line, headers and whatever is held back, the rest of the body is sent in chunks
+// unless the handler set a content length
+func (w *Writer) Flush() error {
+	if w.state == writingStatusLine || w.state == writingHeaders {
+		if err := w.writeImplicitHeaders(-1); err != nil {
+			return err
+		}
+	}
+
+	pending := w.pending
+	w.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+
+	_, err := w.Write(pending)
+
+	return err
+}
+
+// status line is skipped if the handler wrote it through WriteStatusLine, a content length of -1
+// means the length isn't known yet
+func (w *Writer) writeImplicitHeaders(contentLength int) error {
+	if w.state == writingStatusLine {
+		if w.status == 0 {
+			w.status = StatusOK
+		}
+		if err := w.WriteStatusLine(w.status); err != nil {
+			return err
+		}
+	}
+
+	// Header() is merged in by WriteHeaders, only missing defaults are added here
+	h := headers.NewHeaders()
+	if bodyForbidden(w.status) {
+		return w.WriteHeaders(h)
+	}
+	if !w.header.Has("Content-Type") {
+		h.Set("Content-Type", "text/plain")
+	}
+	if !w.header.Has("Content-Length") && !w.header.Has("Transfer-Encoding") {
+		switch {
+		case contentLength >= 0:
+			h.Set("Content-Length", strconv.Itoa(contentLength))
+		case w.version != "1.0":
+			h.Set("Transfer-Encoding", "chunked")
+		}
+		// a http/1.0 client gets neither, the body ends when the connection is closed
+	}
+
+	return w.WriteHeaders(h)
+}
+
+// completes whatever the handler left unfinished, called by the server once the handler returns
+// a body held back in full is sent with its content length, a chunked body is ended
+func (w *Writer) Finish() error {
+	switch w.state {
+	case writingStatusLine, writingHeaders:
+		if err := w.writeImplicitHeaders(len(w.pending) + w.suppressed); err != nil {
+			return err
+		}
+
+		pending := w.pending
+		w.pending = nil
+		if len(pending) > 0 {
+			if _, err := w.Write(pending); err != nil {
+				return err
+			}
+		}
+
+		// chunked encoding set on Header() applies to small bodies too, those chunks still need ending
+		return w.Finish()
+	case writingChunks:
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+
+		return w.WriteTrailers(headers.NewHeaders())
+	case writingTrailers:
+		return w.WriteTrailers(headers.NewHeaders())
+	default:
+		return nil
+	}
+}
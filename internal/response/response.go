@@ -4,98 +4,330 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 
 	"github.com/junwei890/http-1.1/internal/headers"
 )
 
-type Writer struct {
-	Response io.Writer
-}
+type writerState string
 
-type StatusCode int
-
-// only handling status codes I use most often
+// parts of a response must be written in this order, the body is either written as is or in chunks
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusUnauthorized        StatusCode = 401
-	StatusForbidden           StatusCode = 403
-	StatusNotFound            StatusCode = 404
-	StatusInternalServerError StatusCode = 500
+	writingStatusLine writerState = "status line"
+	writingHeaders    writerState = "headers"
+	writingBody       writerState = "body"
+	writingChunks     writerState = "chunked body"
+	writingTrailers   writerState = "trailers"
+	writingDone       writerState = "done"
 )
 
+type Writer struct {
+	Response io.Writer
+	// written along with the headers passed to WriteHeaders, unless those set the same field
+	header  *headers.Headers
+	status  StatusCode
+	closing bool
+	state   writerState
+	// body bytes left to write according to content length, -1 when there is no content length
+	remaining int
+	// body written through Write that is held back until its full length is known
+	pending []byte
+	// set for responses to HEAD requests, the body is measured but never sent
+	suppressBody bool
+	// length of the body held back for a HEAD response, counted instead of kept
+	suppressed int
+	// version written in the status line, the one the client sent
+	version string
+	// set when chunks are asked for by a client that can't decode them, they are written as they
+	// are and the body ends when the connection does
+	closeDelimited bool
+	// asked when the headers are written, the connection is closed if it reports true
+	closeWhen func() bool
+}
+
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		Response: w,
+		header:   headers.NewHeaders(),
+		state:    writingStatusLine,
+		version:  "1.1",
+	}
+}
+
+// the version the client sent, 1.1 unless set, http/1.0 clients are never sent chunks or 1xx
+// responses since they can't understand them
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+// headers to include in the response, lets middleware add fields without the handler knowing
+func (w *Writer) Header() *headers.Headers {
+	return w.header
+}
+
+// status code of the response, zero until one is written or set
+func (w *Writer) Status() StatusCode {
+	return w.status
+}
+
+// marks the connection to be closed once this response is written
+func (w *Writer) CloseAfterResponse() {
+	w.closing = true
+}
+
+// check is asked right before the headers are written, so Connection: close can still be sent
+// if it reports true, the server uses it for a request body the client is still holding back
+func (w *Writer) CloseWhen(check func() bool) {
+	w.closeWhen = check
+}
+
+// reports whether either side asked for the connection to be closed
+func (w *Writer) Closing() bool {
+	return w.closing
+}
+
+func (w *Writer) StatusWritten() bool {
+	return w.state != writingStatusLine
+}
+
+// marks the response as one to a HEAD request, everything but the body is written as usual
+// so handlers can share their logic with GET
+func (w *Writer) SuppressBody() {
+	w.suppressBody = true
+}
+
+// reports whether the response has been written in full, so the client knows where it ends
+func (w *Writer) Done() bool {
+	// a response without a body ends with its headers
+	if w.suppressBody && w.state != writingStatusLine && w.state != writingHeaders {
+		return true
+	}
+
+	return w.state == writingDone
+}
+
+// a non empty body errors for statuses that can't have one
+func (w *Writer) checkBodyAllowed(body []byte) error {
+	if len(body) > 0 && w.StatusWritten() && bodyForbidden(w.status) {
+		return fmt.Errorf("%d responses can't have a body", w.status)
+	}
+
+	return nil
+}
+
+// errors when a part of the response is written out of order
+func (w *Writer) expect(part string, state writerState) error {
+	if w.state == writingDone {
+		return fmt.Errorf("%s written after the response was done", part)
 	}
+	if w.state != state {
+		return fmt.Errorf("%s written out of order, expected %s", part, w.state)
+	}
+
+	return nil
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-	switch statusCode {
-	case 200:
-		if _, err := w.Response.Write([]byte("HTTP/1.1 200 OK\r\n")); err != nil {
-			return err
-		}
-	case 400:
-		if _, err := w.Response.Write([]byte("HTTP/1.1 400 Bad Request\r\n")); err != nil {
-			return err
-		}
-	case 401:
-		if _, err := w.Response.Write([]byte("HTTP/1.1 401 Unauthorized\r\n")); err != nil {
-			return err
-		}
-	case 403:
-		if _, err := w.Response.Write([]byte("HTTP/1.1 403 Forbidden\r\n")); err != nil {
-			return err
-		}
-	case 404:
-		if _, err := w.Response.Write([]byte("HTTP/1.1 404 Not Found\r\n")); err != nil {
-			return err
-		}
-	case 500:
-		if _, err := w.Response.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n")); err != nil {
-			return err
-		}
-	default:
-		// there must be a space between status code and reason phrase even if reason phrase is absent
-		if _, err := w.Response.Write(fmt.Appendf([]byte{}, "HTTP/1.1 %d \r\n", statusCode)); err != nil {
+	if err := w.expect("status line", writingStatusLine); err != nil {
+		return err
+	}
+	if !validStatus(statusCode) {
+		return fmt.Errorf("%d is an invalid status code", statusCode)
+	}
+	// a 1xx would be taken as the whole response while the client waits for the final one
+	if statusCode < 200 {
+		return fmt.Errorf("%d is an interim status code, use WriteInterim to send it", statusCode)
+	}
+	w.state = writingHeaders
+	w.status = statusCode
+
+	// there must be a space between status code and reason phrase even if reason phrase is absent,
+	// which it is for codes that aren't registered
+	if _, err := w.Response.Write(fmt.Appendf([]byte{}, "HTTP/%s %d %s\r\n", w.version, statusCode, StatusText(statusCode))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// 1xx responses sent ahead of the final response, any number of them can be written before the
+// status line, 101 isn't allowed since the connection can't be switched to another protocol
+func (w *Writer) WriteInterim(statusCode StatusCode, h *headers.Headers) error {
+	if err := w.expect("interim response", writingStatusLine); err != nil {
+		return err
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusSwitchingProtocols {
+		return fmt.Errorf("%d is not a valid interim status code", statusCode)
+	}
+	if w.version == "1.0" {
+		return nil
+	}
+
+	if _, err := w.Response.Write(fmt.Appendf([]byte{}, "HTTP/%s %d %s\r\n", w.version, statusCode, StatusText(statusCode))); err != nil {
+		return err
+	}
+	for key, value := range h.All() {
+		if _, err := w.Response.Write(fmt.Appendf([]byte{}, "%s: %s\r\n", key, value)); err != nil {
 			return err
 		}
 	}
+	if _, err := w.Response.Write([]byte("\r\n")); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// tells a client waiting on Expect: 100-continue to send the body, skipped once the final status
+// line is out since that already answers the client
+func (w *Writer) WriteContinue() error {
+	if w.StatusWritten() {
+		return nil
+	}
+
+	return w.WriteInterim(StatusContinue, nil)
+}
+
+// drops whatever the handler set on Header() or held back, so an error response isn't sent with
+// fields meant for a response that never went out
+func (w *Writer) reset() {
+	w.header = headers.NewHeaders()
+	w.pending = nil
+	w.suppressed = 0
+}
+
+// replaces the response with a plain text error and closes the connection after it, headers the
+// handler set are discarded, only possible before the status line is written
+func (w *Writer) WriteError(statusCode StatusCode, message string) error {
+	if err := w.expect("error response", writingStatusLine); err != nil {
+		return err
+	}
+	w.reset()
+	w.CloseAfterResponse()
+
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+
+	responseBody := []byte(message)
+	if err := w.WriteHeaders(SetDefaultHeaders(len(responseBody))); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(responseBody)
+
+	return err
+}
+
 // default headers if none are set
-func SetDefaultHeaders(length int) headers.Headers {
+func SetDefaultHeaders(length int) *headers.Headers {
 	headers := headers.NewHeaders()
 
-	headers["Content-Length"] = strconv.Itoa(length)
-	headers["Connection"] = "close"
-	headers["Content-Type"] = "text/plain"
+	headers.Set("Content-Length", strconv.Itoa(length))
+	headers.Set("Content-Type", "text/plain")
 
 	return headers
 }
 
-// override default response headers
-func OverrideDefaultHeaders(headers headers.Headers, fieldName, fieldValue string) {
+// override default response headers, a thin wrapper around Set kept for handlers written before
+// headers had methods
+func OverrideDefaultHeaders(headers *headers.Headers, fieldName, fieldValue string) {
 	// if response body is chunked encoded, content length header should be replaced
-	if fieldName == "Transfer-Encoding" && fieldValue == "chunked" {
-		delete(headers, "Content-Length")
-		headers[fieldName] = fieldValue
-		return
+	if strings.EqualFold(fieldName, "Transfer-Encoding") {
+		headers.Del("Content-Length")
 	}
 
-	headers[fieldName] = fieldValue
+	headers.Set(fieldName, fieldValue)
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
-	for key, value := range headers {
+// fields are written in the order they were set, those from Header() first
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
+	if err := w.expect("headers", writingHeaders); err != nil {
+		return err
+	}
+
+	merged := headers.NewHeaders()
+	for key, value := range w.header.All() {
+		if !h.Has(key) {
+			merged.Add(key, value)
+		}
+	}
+	for key, value := range h.All() {
+		merged.Add(key, value)
+	}
+
+	// the framing headers decide how the body is written and when the response is done,
+	// checked before anything is written so a bad content length doesn't leave half the headers out
+	state := writingBody
+	remaining := -1
+	for key, value := range merged.All() {
+		if strings.EqualFold(key, "Transfer-Encoding") && strings.EqualFold(strings.TrimSpace(value), "chunked") {
+			state = writingChunks
+		}
+		if strings.EqualFold(key, "Content-Length") {
+			length, err := strconv.Atoi(value)
+			if err != nil || length < 0 {
+				return fmt.Errorf("%s not a valid content length", value)
+			}
+			remaining = length
+		}
+	}
+
+	noBody := bodyForbidden(w.status)
+	if state == writingChunks && w.version == "1.0" {
+		w.closeDelimited = true
+	}
+	if w.closeWhen != nil && w.closeWhen() {
+		w.closing = true
+	}
+	// without either framing header, the body only ends when the connection does
+	if ((state == writingBody && remaining == -1) || w.closeDelimited) && !noBody && !w.suppressBody {
+		w.closing = true
+	}
+	if (state == writingBody && remaining == 0) || noBody {
+		state = writingDone
+	}
+	w.state = state
+	w.remaining = remaining
+
+	// repeated lines are joined, so Connection is only written once, after every other field
+	connection, _ := merged.Get("Connection")
+	for option := range strings.SplitSeq(connection, ",") {
+		// handler can also ask for the connection to be closed
+		if strings.EqualFold(strings.TrimSpace(option), "close") {
+			w.closing = true
+		}
+	}
+
+	for key, value := range merged.All() {
+		if strings.EqualFold(key, "Connection") {
+			continue
+		}
+		// 204 responses must not send framing headers, 304 keeps them since they describe what a
+		// GET would have returned
+		if w.status == StatusNoContent && (strings.EqualFold(key, "Content-Length") || strings.EqualFold(key, "Transfer-Encoding")) {
+			continue
+		}
+		if w.closeDelimited && strings.EqualFold(key, "Transfer-Encoding") {
+			continue
+		}
+
 		if _, err := w.Response.Write(fmt.Appendf([]byte{}, "%s: %s\r\n", key, value)); err != nil {
 			return err
 		}
 	}
 
+	if w.closing {
+		connection = "close"
+	} else if w.version == "1.0" && connection == "" {
+		// http/1.0 clients assume the connection is closed unless told otherwise
+		connection = "keep-alive"
+	}
+	if connection != "" {
+		if _, err := w.Response.Write(fmt.Appendf([]byte{}, "Connection: %s\r\n", connection)); err != nil {
+			return err
+		}
+	}
+
 	// extra /r/n at the end of headers
 	if _, err := w.Response.Write([]byte("\r\n")); err != nil {
 		return err
@@ -105,16 +337,55 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 }
 
 func (w *Writer) WriteBody(body []byte) (int, error) {
-	n, err := w.Response.Write(body)
-	if err != nil {
+	if err := w.checkBodyAllowed(body); err != nil {
 		return 0, err
 	}
+	if err := w.expect("body", writingBody); err != nil {
+		return 0, err
+	}
+	if w.remaining != -1 && len(body) > w.remaining {
+		return 0, fmt.Errorf("body of %d bytes is longer than the %d bytes left of the content length", len(body), w.remaining)
+	}
+
+	// still counted against the content length, so a HEAD response errors wherever GET would
+	n := len(body)
+	if !w.suppressBody {
+		var err error
+		n, err = w.Response.Write(body)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if w.remaining != -1 {
+		w.remaining -= n
+		if w.remaining == 0 {
+			w.state = writingDone
+		}
+	}
 
 	return n, nil
 }
 
 // writes chunks as it is received
 func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
+	if err := w.checkBodyAllowed(body); err != nil {
+		return 0, err
+	}
+	if err := w.expect("chunk", writingChunks); err != nil {
+		return 0, err
+	}
+	// an empty chunk would be mistaken for the end of the body
+	if len(body) == 0 {
+		return 0, nil
+	}
+	if w.suppressBody {
+		return len(body), nil
+	}
+	if w.closeDelimited {
+		return w.Response.Write(body)
+	}
+
 	n := 0
 	// length of chunk should be in hexadecimal
 	bytesWritten, err := w.Response.Write(fmt.Appendf([]byte{}, "%X\r\n", len(body)))
@@ -141,17 +412,35 @@ func (w *Writer) WriteChunkedBody(body []byte) (int, error) {
 
 // this ends the entire chunked body with a 0 length of chunk
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if err := w.expect("last chunk", writingChunks); err != nil {
+		return 0, err
+	}
+	if w.suppressBody || w.closeDelimited {
+		w.state = writingTrailers
+		return 0, nil
+	}
+
 	n, err := w.Response.Write([]byte("0\r\n"))
 	if err != nil {
 		return 0, err
 	}
+	w.state = writingTrailers
 
 	return n, err
 }
 
-// optional trailers after the chunked body
-func (w *Writer) WriteTrailers(trailers headers.Headers) error {
-	for key, value := range trailers {
+// optional trailers after the chunked body, must still be called with no trailers to end the response
+func (w *Writer) WriteTrailers(trailers *headers.Headers) error {
+	if err := w.expect("trailers", writingTrailers); err != nil {
+		return err
+	}
+	// trailers can't be sent without chunks, they are dropped
+	if w.suppressBody || w.closeDelimited {
+		w.state = writingDone
+		return nil
+	}
+
+	for key, value := range trailers.All() {
 		if _, err := w.Response.Write([]byte(fmt.Appendf([]byte{}, "%s: %s\r\n", key, value))); err != nil {
 			return err
 		}
@@ -161,6 +450,7 @@ func (w *Writer) WriteTrailers(trailers headers.Headers) error {
 	if _, err := w.Response.Write([]byte("\r\n")); err != nil {
 		return err
 	}
+	w.state = writingDone
 
 	return nil
 }
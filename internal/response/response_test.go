@@ -0,0 +1,542 @@
+package response
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/junwei890/http-1.1/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// builds headers from name value pairs, in order
+func fields(pairs ...string) *headers.Headers {
+	h := headers.NewHeaders()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h.Set(pairs[i], pairs[i+1])
+	}
+
+	return h
+}
+
+func TestWriteOrder(t *testing.T) {
+	// test: status line, headers and body in order
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(5)))
+	assert.False(t, w.Done())
+	_, err := w.WriteBody([]byte("he"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("llo"))
+	require.NoError(t, err)
+	assert.True(t, w.Done())
+	assert.False(t, w.Closing())
+
+	// test: body before status line
+	w = NewWriter(&bytes.Buffer{})
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+
+	// test: headers before status line
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteHeaders(SetDefaultHeaders(0)))
+
+	// test: status line twice
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.Error(t, w.WriteStatusLine(StatusOK))
+
+	// test: headers twice
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(5)))
+	require.Error(t, w.WriteHeaders(SetDefaultHeaders(5)))
+
+	// test: body longer than content length isn't written
+	written := buffer.Len()
+	_, err = w.WriteBody([]byte("hello world"))
+	require.Error(t, err)
+	assert.Equal(t, written, buffer.Len())
+
+	// test: body after it was written in full
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("!"))
+	require.Error(t, err)
+
+	// test: chunks on a response that isn't chunked
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(5)))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.Error(t, err)
+
+	// test: invalid content length leaves nothing written
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	written = buffer.Len()
+	h := SetDefaultHeaders(0)
+	h.Set("Content-Length", "five")
+	require.Error(t, w.WriteHeaders(h))
+	assert.Equal(t, written, buffer.Len())
+
+	// test: no content length means the body ends with the connection
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("Content-Type", "text/plain")))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, w.Closing())
+	assert.False(t, w.Done())
+}
+
+func TestWriteChunked(t *testing.T) {
+	// test: chunks, last chunk then trailers in order
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	h := fields("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte{})
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte(" world!"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.False(t, w.Done())
+	require.NoError(t, w.WriteTrailers(fields("X-Checksum", "abc")))
+	assert.True(t, w.Done())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n7\r\n world!\r\n0\r\nX-Checksum: abc\r\n\r\n", buffer.String())
+
+	// test: unchunked body on a chunked response
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+
+	// test: trailers before the last chunk
+	require.Error(t, w.WriteTrailers(headers.NewHeaders()))
+
+	// test: chunks after the last chunk
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.Error(t, err)
+
+	// test: trailers twice
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	require.Error(t, w.WriteTrailers(headers.NewHeaders()))
+}
+
+func TestWriteImplicit(t *testing.T) {
+	// test: small body is sent with a content length once the handler is done
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	n, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 0, buffer.Len())
+	assert.Equal(t, StatusOK, w.Status())
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+	assert.True(t, bytes.HasPrefix(buffer.Bytes(), []byte("HTTP/1.1 200 OK\r\n")))
+	assert.Contains(t, buffer.String(), "Content-Length: 5\r\n")
+	assert.Contains(t, buffer.String(), "Content-Type: text/plain\r\n")
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("\r\n\r\nhello")))
+
+	// test: status and headers set before writing
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(StatusNotFound)
+	w.WriteHeader(StatusInternalServerError)
+	_, err = w.Write([]byte("<p>gone</p>"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasPrefix(buffer.Bytes(), []byte("HTTP/1.1 404 Not Found\r\n")))
+	assert.Contains(t, buffer.String(), "Content-Type: text/html\r\n")
+	assert.NotContains(t, buffer.String(), "text/plain")
+
+	// test: an invalid or 1xx status code is sent as a 500 instead of dropping the response
+	for _, statusCode := range []StatusCode{42, 600, StatusContinue} {
+		buffer = &bytes.Buffer{}
+		w = NewWriter(buffer)
+		w.WriteHeader(statusCode)
+		_, err = w.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.True(t, bytes.HasPrefix(buffer.Bytes(), []byte("HTTP/1.1 500 Internal Server Error\r\n")))
+		assert.True(t, w.Done())
+	}
+
+	// test: chunked encoding set on Header() for a body small enough to be held back
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.Header().Set("Transfer-Encoding", "chunked")
+	_, err = w.Write([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+	assert.NotContains(t, buffer.String(), "Content-Length")
+	assert.Contains(t, buffer.String(), "Transfer-Encoding: chunked\r\n")
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("\r\n\r\n2\r\nhi\r\n0\r\n\r\n")))
+
+	// test: status can't change after the first write
+	w = NewWriter(&bytes.Buffer{})
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	w.WriteHeader(StatusNotFound)
+	assert.Equal(t, StatusOK, w.Status())
+
+	// test: no writes at all is an empty 200
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+	assert.Contains(t, buffer.String(), "Content-Length: 0\r\n")
+
+	// test: large body switches to chunked encoding
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	body := bytes.Repeat([]byte("a"), pendingLimit+1)
+	_, err = w.Write(body)
+	require.NoError(t, err)
+	assert.Contains(t, buffer.String(), "Transfer-Encoding: chunked\r\n")
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("\r\n0\r\n\r\n")))
+
+	// test: content length set by the handler is streamed as is
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.Header().Set("Content-Length", "5")
+	_, err = w.Write([]byte("he"))
+	require.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("\r\n\r\nhe")))
+	_, err = w.Write([]byte("llo"))
+	require.NoError(t, err)
+	assert.True(t, w.Done())
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buffer.String(), "chunked")
+
+	// test: flush commits the headers early
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.True(t, w.StatusWritten())
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("5\r\nhello\r\n")))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+
+	// test: write after the low level status line
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusForbidden))
+	_, err = w.Write([]byte("no"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasPrefix(buffer.Bytes(), []byte("HTTP/1.1 403 Forbidden\r\n")))
+	assert.Equal(t, 1, bytes.Count(buffer.Bytes(), []byte("HTTP/1.1")))
+	assert.Contains(t, buffer.String(), "Content-Length: 2\r\n")
+
+	// test: write after the response is done
+	_, err = w.Write([]byte("!"))
+	require.Error(t, err)
+}
+
+func TestWriteStatusLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode StatusCode
+		want       string
+		wantErr    bool
+	}{
+		// test: registered codes get their reason phrase
+		{name: "ok", statusCode: StatusOK, want: "HTTP/1.1 200 OK\r\n"},
+		{name: "created", statusCode: StatusCreated, want: "HTTP/1.1 201 Created\r\n"},
+		{name: "no content", statusCode: StatusNoContent, want: "HTTP/1.1 204 No Content\r\n"},
+		{name: "moved permanently", statusCode: StatusMovedPermanently, want: "HTTP/1.1 301 Moved Permanently\r\n"},
+		{name: "not modified", statusCode: StatusNotModified, want: "HTTP/1.1 304 Not Modified\r\n"},
+		{name: "too many requests", statusCode: StatusTooManyRequests, want: "HTTP/1.1 429 Too Many Requests\r\n"},
+		{name: "service unavailable", statusCode: StatusServiceUnavailable, want: "HTTP/1.1 503 Service Unavailable\r\n"},
+
+		// test: unregistered codes keep the space before the empty reason phrase
+		{name: "unregistered", statusCode: 299, want: "HTTP/1.1 299 \r\n"},
+
+		// test: codes outside of the 5 classes
+		{name: "too small", statusCode: 99, wantErr: true},
+		{name: "too large", statusCode: 600, wantErr: true},
+		{name: "four digits", statusCode: 1000, wantErr: true},
+		{name: "zero", statusCode: 0, wantErr: true},
+
+		// test: 1xx codes can't be the final status
+		{name: "continue", statusCode: StatusContinue, wantErr: true},
+		{name: "early hints", statusCode: StatusEarlyHints, wantErr: true},
+		{name: "unregistered interim", statusCode: 199, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			w := NewWriter(buffer)
+			err := w.WriteStatusLine(tc.statusCode)
+			if tc.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, 0, buffer.Len())
+				assert.False(t, w.StatusWritten())
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, buffer.String())
+		})
+	}
+
+	// test: every registered code has a reason phrase
+	for statusCode, text := range statusText {
+		assert.True(t, validStatus(statusCode))
+		assert.NotEmpty(t, text)
+	}
+	assert.Equal(t, "", StatusText(299))
+}
+
+func TestWriteNoBody(t *testing.T) {
+	// test: HEAD response keeps the content length but drops the body
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SuppressBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(5)))
+	assert.True(t, w.Done())
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Contains(t, buffer.String(), "Content-Length: 5\r\n")
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("\r\n\r\n")))
+
+	// test: HEAD response still errors where GET would
+	_, err = w.WriteBody([]byte("!"))
+	require.Error(t, err)
+
+	// test: implicit HEAD response measures bodies of any size
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.SuppressBody()
+	_, err = w.Write(bytes.Repeat([]byte("a"), pendingLimit*2))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+	assert.Contains(t, buffer.String(), "Content-Length: 8192\r\n")
+	assert.True(t, bytes.HasSuffix(buffer.Bytes(), []byte("\r\n\r\n")))
+
+	// test: chunked HEAD response sends no chunks
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.SuppressBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("Transfer-Encoding", "chunked")))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(fields("X-Checksum", "abc")))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", buffer.String())
+
+	// test: 204 ends with its headers and drops framing headers
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(fields("Content-Length", "0")))
+	assert.True(t, w.Done())
+	assert.False(t, w.Closing())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buffer.String())
+	_, err = w.WriteBody([]byte("hello"))
+	require.Error(t, err)
+
+	// test: 304 keeps the content length of what GET would have sent
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusNotModified))
+	require.NoError(t, w.WriteHeaders(fields("Content-Length", "5")))
+	assert.True(t, w.Done())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n", buffer.String())
+
+	// test: implicit 204 has no body and no default headers
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.WriteHeader(StatusNoContent)
+	_, err = w.Write([]byte("hello"))
+	require.Error(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Done())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buffer.String())
+}
+
+func TestWriteInterim(t *testing.T) {
+	// test: several interim responses before the final one
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	require.NoError(t, w.WriteInterim(StatusEarlyHints, fields("Link", "</style.css>; rel=preload; as=style")))
+	require.NoError(t, w.WriteInterim(StatusEarlyHints, fields("Link", "</image>; rel=preload; as=image")))
+	assert.False(t, w.StatusWritten())
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(0)))
+	assert.True(t, strings.HasPrefix(buffer.String(), "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\nHTTP/1.1 103 Early Hints\r\nLink: </image>; rel=preload; as=image\r\n\r\nHTTP/1.1 200 OK\r\n"))
+
+	// test: interim response works with the implicit API
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteInterim(StatusEarlyHints, nil))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buffer.String(), "HTTP/1.1 103 Early Hints\r\n\r\nHTTP/1.1 200 OK\r\n"))
+
+	// test: interim response after the final status line
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.Error(t, w.WriteInterim(StatusEarlyHints, nil))
+
+	// test: continue is skipped once the final status line is out
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	written := buffer.Len()
+	require.NoError(t, w.WriteContinue())
+	assert.Equal(t, written, buffer.Len())
+
+	// test: only 1xx codes, other than switching protocols
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteInterim(StatusOK, nil))
+	require.Error(t, w.WriteInterim(StatusSwitchingProtocols, nil))
+
+	// test: a body still held back closes the connection, decided when the headers are written
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	waiting := true
+	w.CloseWhen(func() bool {
+		return waiting
+	})
+	require.NoError(t, w.WriteStatusLine(StatusExpectationFailed))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(0)))
+	assert.True(t, w.Closing())
+	assert.True(t, strings.HasSuffix(buffer.String(), "Connection: close\r\n\r\n"))
+
+	// test: not once the body was asked for
+	w = NewWriter(&bytes.Buffer{})
+	waiting = false
+	w.CloseWhen(func() bool {
+		return waiting
+	})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(SetDefaultHeaders(0)))
+	assert.False(t, w.Closing())
+}
+
+func TestWriteHTTP10(t *testing.T) {
+	// test: status line has the version the client sent, and keep alive has to be spelt out
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.SetVersion("1.0")
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\nConnection: keep-alive\r\n\r\nhello", buffer.String())
+	assert.True(t, w.Done())
+	assert.False(t, w.Closing())
+
+	// test: large bodies end with the connection instead of being chunked
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.SetVersion("1.0")
+	body := strings.Repeat("a", pendingLimit+1)
+	_, err = w.Write([]byte(body))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n"+body, buffer.String())
+	assert.True(t, w.Closing())
+
+	// test: chunks and trailers asked for explicitly are written without framing
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(fields("Transfer-Encoding", "chunked", "Trailer", "X-Content-Length")))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(fields("X-Content-Length", "11")))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nTrailer: X-Content-Length\r\nConnection: close\r\n\r\nhello world", buffer.String())
+	assert.True(t, w.Done())
+	assert.True(t, w.Closing())
+
+	// test: interim responses are skipped
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.SetVersion("1.0")
+	require.NoError(t, w.WriteInterim(StatusEarlyHints, nil))
+	require.NoError(t, w.WriteContinue())
+	assert.Empty(t, buffer.String())
+}
+
+func TestWriteError(t *testing.T) {
+	// test: headers and body the handler left behind are dropped
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Set-Cookie", "session=abc")
+	w.WriteHeader(StatusCreated)
+	_, err := w.Write([]byte("partial"))
+	require.NoError(t, err)
+	require.NoError(t, w.WriteError(StatusInternalServerError, "oops"))
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 4\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\noops", buffer.String())
+	assert.True(t, w.Done())
+	assert.True(t, w.Closing())
+
+	// test: too late once the status line is out
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.Error(t, w.WriteError(StatusInternalServerError, "oops"))
+}
+
+func TestWriteGolden(t *testing.T) {
+	// test: raw response is the same on every run, fields in the order they were set
+	for range 10 {
+		buffer := &bytes.Buffer{}
+		w := NewWriter(buffer)
+		w.Header().Set("X-Request-ID", "abc")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/html")
+		_, err := w.Write([]byte("<p>hello</p>"))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\nX-Request-ID: abc\r\nCache-Control: no-store\r\nContent-Type: text/html\r\nContent-Length: 12\r\n\r\n<p>hello</p>", buffer.String())
+	}
+
+	// test: connection is always last
+	buffer := &bytes.Buffer{}
+	w := NewWriter(buffer)
+	w.CloseAfterResponse()
+	require.NoError(t, w.WriteStatusLine(StatusNotFound))
+	require.NoError(t, w.WriteHeaders(fields("content-type", "text/plain", "Connection", "keep-alive", "content-length", "0")))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\ncontent-type: text/plain\r\ncontent-length: 0\r\nConnection: close\r\n\r\n", buffer.String())
+
+	// test: repeated fields are written as separate lines
+	buffer = &bytes.Buffer{}
+	w = NewWriter(buffer)
+	w.Header().Add("Set-Cookie", "id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	w.Header().Add("Set-Cookie", "lang=en")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nSet-Cookie: id=a3fWa; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\nSet-Cookie: lang=en\r\nContent-Type: text/plain\r\nContent-Length: 0\r\n\r\n", buffer.String())
+}
@@ -0,0 +1,240 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/junwei890/http-1.1/internal/request"
+	"github.com/junwei890/http-1.1/internal/response"
+	"github.com/junwei890/http-1.1/internal/server"
+)
+
+type segmentKind int
+
+// ordered from most to least specific
+const (
+	literalSegment segmentKind = iota
+	paramSegment
+	wildcardSegment
+)
+
+type segment struct {
+	kind segmentKind
+	// literal text, or the name of the captured parameter
+	value string
+}
+
+type route struct {
+	pattern  string
+	method   string
+	segments []segment
+	handler  server.Handler
+}
+
+// dispatches requests to handlers registered by method and path pattern
+type Router struct {
+	routes []*route
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// patterns take the form "[METHOD ]/path", a missing method matches every method
+// a {name} segment captures a single path segment, a trailing {name...} captures the rest of the path
+// panics on malformed or duplicate patterns, since those are programming errors
+func (rt *Router) Handle(pattern string, handler server.Handler) {
+	newRoute, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	newRoute.handler = handler
+
+	for _, existing := range rt.routes {
+		if existing.method == newRoute.method && existing.sameShape(newRoute) {
+			panic(fmt.Sprintf("pattern %s conflicts with %s", pattern, existing.pattern))
+		}
+	}
+
+	rt.routes = append(rt.routes, newRoute)
+}
+
+func parsePattern(pattern string) (*route, error) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("pattern %s must have a path starting with /", pattern)
+	}
+
+	r := &route{
+		pattern: pattern,
+		method:  method,
+	}
+
+	names := map[string]struct{}{}
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("pattern %s has a malformed segment %s", pattern, part)
+			}
+			r.segments = append(r.segments, segment{kind: literalSegment, value: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		kind := paramSegment
+		if wildcard, ok := strings.CutSuffix(name, "..."); ok {
+			// anything after would never be reached
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("pattern %s has a wildcard that isn't the last segment", pattern)
+			}
+			name = wildcard
+			kind = wildcardSegment
+		}
+
+		if name == "" || strings.ContainsAny(name, "{}") {
+			return nil, fmt.Errorf("pattern %s has a malformed segment %s", pattern, part)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("pattern %s captures %s more than once", pattern, name)
+		}
+		names[name] = struct{}{}
+
+		r.segments = append(r.segments, segment{kind: kind, value: name})
+	}
+
+	return r, nil
+}
+
+// parameter names don't matter, two routes of the same shape match the exact same paths
+func (r *route) sameShape(other *route) bool {
+	return slices.EqualFunc(r.segments, other.segments, func(a, b segment) bool {
+		return a.kind == b.kind && (a.kind != literalSegment || a.value == b.value)
+	})
+}
+
+// returns the captured parameters if the path matches
+func (r *route) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := map[string]string{}
+
+	for i, seg := range r.segments {
+		// a wildcard still needs its own segment, even if it is empty
+		if i >= len(parts) {
+			return nil, false
+		}
+
+		switch seg.kind {
+		case literalSegment:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case paramSegment:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[seg.value] = parts[i]
+		case wildcardSegment:
+			params[seg.value] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+	}
+
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// a GET route also answers HEAD, the server drops the body it writes
+func (r *route) matchMethod(method string) bool {
+	return r.method == "" || r.method == method || (method == "HEAD" && r.method == "GET")
+}
+
+// literal segments beat parameters which beat wildcards, compared from the left,
+// ties go to the route that names the request's method, then to the one that names any method
+func (r *route) moreSpecific(other *route, method string) bool {
+	for i := range min(len(r.segments), len(other.segments)) {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(r.segments) != len(other.segments) {
+		return len(r.segments) > len(other.segments)
+	}
+
+	if r.method == method || other.method == method {
+		return r.method == method && other.method != method
+	}
+
+	return r.method != "" && other.method == ""
+}
+
+// has the signature of a server.Handler, so it can be passed straight to server.Serve
+func (rt *Router) Route(w *response.Writer, r *request.Request) {
+	// CONNECT and OPTIONS * have no path to match against
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		notFound(w)
+		return
+	}
+
+	var best *route
+	var bestParams map[string]string
+	allowed := []string{}
+
+	for _, candidate := range rt.routes {
+		params, ok := candidate.match(r.URL.Path)
+		if !ok {
+			continue
+		}
+
+		if !candidate.matchMethod(r.RequestLine.Method) {
+			allowed = append(allowed, candidate.method)
+			if candidate.method == "GET" {
+				allowed = append(allowed, "HEAD")
+			}
+			continue
+		}
+
+		if best == nil || candidate.moreSpecific(best, r.RequestLine.Method) {
+			best = candidate
+			bestParams = params
+		}
+	}
+
+	if best == nil {
+		if len(allowed) > 0 {
+			slices.Sort(allowed)
+			methodNotAllowed(w, slices.Compact(allowed))
+			return
+		}
+
+		notFound(w)
+		return
+	}
+
+	for name, value := range bestParams {
+		r.SetPathValue(name, value)
+	}
+	best.handler(w, r)
+}
+
+// #nosec G104
+func notFound(w *response.Writer) {
+	w.WriteHeader(response.StatusNotFound)
+	w.Write([]byte("404 page not found"))
+}
+
+// #nosec G104
+func methodNotAllowed(w *response.Writer, allowed []string) {
+	// lets the client know which methods the path does support
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(response.StatusMethodNotAllowed)
+	w.Write([]byte("405 method not allowed"))
+}
@@ -0,0 +1,155 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/junwei890/http-1.1/internal/request"
+	"github.com/junwei890/http-1.1/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// responds with the name of the handler and the parameters it was given
+func namedHandler(name string, params ...string) func(w *response.Writer, r *request.Request) {
+	return func(w *response.Writer, r *request.Request) {
+		body := name
+		for _, param := range params {
+			body += " " + param + "=" + r.PathValue(param)
+		}
+
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.SetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func serve(t *testing.T, rt *Router, method, target string) string {
+	r, err := request.RequestParser(strings.NewReader(method + " " + target + " HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+
+	buffer := &bytes.Buffer{}
+	w := response.NewWriter(buffer)
+	rt.Route(w, r)
+	require.NoError(t, w.Finish())
+
+	return buffer.String()
+}
+
+func TestRoute(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /", namedHandler("root"))
+	rt.Handle("GET /users/{id}", namedHandler("user", "id"))
+	rt.Handle("GET /users/me", namedHandler("me"))
+	rt.Handle("DELETE /users/{id}", namedHandler("delete user", "id"))
+	rt.Handle("GET /users/{id}/posts/{post}", namedHandler("post", "id", "post"))
+	rt.Handle("/static/{path...}", namedHandler("static", "path"))
+	rt.Handle("GET /static/favicon.ico", namedHandler("favicon"))
+
+	// test: exact match
+	res := serve(t, rt, "GET", "/")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nroot"))
+
+	// test: path parameter
+	res = serve(t, rt, "GET", "/users/42")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nuser id=42"))
+
+	// test: literal segment beats a parameter
+	res = serve(t, rt, "GET", "/users/me")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nme"))
+
+	// test: same path, different method
+	res = serve(t, rt, "DELETE", "/users/42")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\ndelete user id=42"))
+
+	// test: several parameters
+	res = serve(t, rt, "GET", "/users/42/posts/7")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\npost id=42 post=7"))
+
+	// test: wildcard captures the rest of the path, for any method
+	res = serve(t, rt, "POST", "/static/css/main.css")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nstatic path=css/main.css"))
+
+	// test: wildcard can capture nothing
+	res = serve(t, rt, "GET", "/static/")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nstatic path="))
+
+	// test: literal beats wildcard
+	res = serve(t, rt, "GET", "/static/favicon.ico")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nfavicon"))
+
+	// test: no match
+	res = serve(t, rt, "GET", "/cats")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+
+	// test: empty parameter doesn't match
+	res = serve(t, rt, "GET", "/users/")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+
+	// test: extra segments don't match
+	res = serve(t, rt, "GET", "/users/42/extra")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+
+	// test: wildcard needs its own segment
+	res = serve(t, rt, "GET", "/static")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+
+	// test: query isn't part of the path
+	res = serve(t, rt, "GET", "/users/42?tab=posts")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nuser id=42"))
+
+	// test: matched against the decoded path
+	res = serve(t, rt, "GET", "/static/caf%C3%A9.css")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nstatic path=café.css"))
+
+	// test: absolute form is matched on its path
+	res = serve(t, rt, "GET", "http://example.com/users/42")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nuser id=42"))
+
+	// test: targets without a path
+	res = serve(t, rt, "OPTIONS", "*")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+	res = serve(t, rt, "CONNECT", "example.com:443")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"))
+
+	// test: path matches but method doesn't
+	res = serve(t, rt, "PUT", "/users/42")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, res, "Allow: DELETE, GET, HEAD\r\n")
+
+	// test: GET route answers HEAD
+	res = serve(t, rt, "HEAD", "/users/42")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"))
+
+	// test: HEAD route beats the GET route
+	rt.Handle("HEAD /users/{id}", namedHandler("head user", "id"))
+	res = serve(t, rt, "HEAD", "/users/42")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nhead user id=42"))
+	res = serve(t, rt, "GET", "/users/42")
+	assert.True(t, strings.HasSuffix(res, "\r\n\r\nuser id=42"))
+}
+
+func TestHandlePanics(t *testing.T) {
+	rt := New()
+	rt.Handle("GET /users/{id}", namedHandler("user"))
+
+	// test: duplicate pattern, even with a different parameter name
+	assert.Panics(t, func() { rt.Handle("GET /users/{userID}", namedHandler("user")) })
+
+	// test: same path with a different method is fine
+	assert.NotPanics(t, func() { rt.Handle("POST /users/{id}", namedHandler("user")) })
+
+	// test: missing leading slash
+	assert.Panics(t, func() { rt.Handle("GET users", namedHandler("user")) })
+
+	// test: wildcard before the last segment
+	assert.Panics(t, func() { rt.Handle("GET /{path...}/edit", namedHandler("user")) })
+
+	// test: malformed segment
+	assert.Panics(t, func() { rt.Handle("GET /users/{id", namedHandler("user")) })
+
+	// test: parameter captured twice
+	assert.Panics(t, func() { rt.Handle("GET /{id}/{id}", namedHandler("user")) })
+}
@@ -0,0 +1,13 @@
+package server
+
+// wraps a handler to add behaviour before and after it runs
+type Middleware func(Handler) Handler
+
+// the first middleware is the outermost, so it sees the request first and the response last
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/junwei890/http-1.1/internal/request"
+	"github.com/junwei890/http-1.1/internal/response"
+)
+
+// configures the server when passed to Serve
+type Option func(*Server)
+
+// caps how much of each request is accepted, request.DefaultLimits are used otherwise
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// deadlines applied to every connection, zero fields fall back to the defaults
+type Timeouts struct {
+	// time allowed to send the request line and headers once the first byte arrives, 408 after
+	ReadHeader time.Duration
+	// time allowed to send the entire request including the body, measured from the first byte
+	Read time.Duration
+	// time allowed for each response to be written
+	Write time.Duration
+	// time a keep-alive connection can sit without a new request before it is closed
+	Idle time.Duration
+}
+
+var DefaultTimeouts = Timeouts{
+	ReadHeader: 10 * time.Second,
+	Read:       time.Minute,
+	Write:      time.Minute,
+	Idle:       2 * time.Minute,
+}
+
+// deadlines applied to each connection, DefaultTimeouts are used otherwise
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *Server) {
+		if timeouts.ReadHeader <= 0 {
+			timeouts.ReadHeader = DefaultTimeouts.ReadHeader
+		}
+		if timeouts.Read <= 0 {
+			timeouts.Read = DefaultTimeouts.Read
+		}
+		if timeouts.Write <= 0 {
+			timeouts.Write = DefaultTimeouts.Write
+		}
+		if timeouts.Idle <= 0 {
+			timeouts.Idle = DefaultTimeouts.Idle
+		}
+
+		s.timeouts = timeouts
+	}
+}
+
+// paths with dot segments or repeated slashes are always normalized before the handler sees them,
+// with this option the client is redirected to the normalized path instead, 301 lets clients
+// retry with GET while 308 keeps the method and body, any other status code panics
+func WithPathRedirect(statusCode response.StatusCode) Option {
+	if statusCode != response.StatusMovedPermanently && statusCode != response.StatusPermanentRedirect {
+		panic(fmt.Sprintf("path redirect needs a 301 or 308, not %d", statusCode))
+	}
+
+	return func(s *Server) {
+		s.pathRedirect = statusCode
+	}
+}
+
+// keeps repeated slashes in request paths instead of collapsing them, for when /a//b and /a/b
+// have to be told apart
+func WithDuplicateSlashes() Option {
+	return func(s *Server) {
+		s.paths.KeepDuplicateSlashes = true
+	}
+}
+
+// accepts %2F in request paths instead of answering with a 400, it stays encoded in RawPath but
+// is decoded in Path, so handlers that need to tell it apart from a separator must use RawPath
+func WithEncodedSlashes() Option {
+	return func(s *Server) {
+		s.paths.AllowEncodedSlashes = true
+	}
+}
@@ -1,10 +1,15 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/junwei890/http-1.1/internal/request"
 	"github.com/junwei890/http-1.1/internal/response"
@@ -12,10 +17,75 @@ import (
 
 type Handler func(w *response.Writer, r *request.Request)
 
+// panicking with this drops the connection without a response or a log, for middleware that has
+// already dealt with a panic but can't finish the response
+var ErrAbortHandler = errors.New("handler aborted")
+
 type Server struct {
 	handler  Handler
 	listener net.Listener
-	closed   atomic.Bool
+	limits   request.Limits
+	paths    request.PathPolicy
+	timeouts Timeouts
+	// zero unless non canonical paths are redirected
+	pathRedirect response.StatusCode
+	closed       atomic.Bool
+	// tracked so shutdown can tell idle connections apart from ones with requests in flight
+	mu    sync.Mutex
+	conns map[net.Conn]connState
+	wg    sync.WaitGroup
+}
+
+type connState string
+
+const (
+	stateIdle   connState = "idle"
+	stateActive connState = "active"
+)
+
+// refuses new connections once the server is closed
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed.Load() {
+		return false
+	}
+
+	s.conns[conn] = stateIdle
+	s.wg.Add(1)
+
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.wg.Done()
+}
+
+// records what the connection is doing, reports false once the server is closed
+func (s *Server) setState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conns[conn] = state
+
+	return !s.closed.Load()
+}
+
+// #nosec G104
+func (s *Server) closeConns(state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn, connState := range s.conns {
+		if state == "" || connState == state {
+			conn.Close()
+		}
+	}
 }
 
 // #nosec G104
@@ -23,26 +93,144 @@ func (s *Server) handle(conn net.Conn) {
 	defer func() {
 		log.Printf("connection with %s, closed", conn.RemoteAddr().String())
 		conn.Close()
+		s.untrackConn(conn)
 	}()
 
-	w := response.NewWriter(conn)
-	// parse incoming requests with the parser written earlier
-	req, err := request.RequestParser(conn)
-	if err != nil {
-		// if parsing fails, respond with 400
-		w.WriteStatusLine(response.StatusBadRequest)
+	// requests are read and answered in order, pipelined requests wait in the reader
+	reader := request.NewReaderWithLimits(conn, s.limits)
+	reader.SetPathPolicy(s.paths)
 
-		responseBody := []byte(err.Error())
+	// keep serving requests on the same connection until either side asks to close
+	for {
+		// idle connections are closed straight away when shutting down
+		if !s.setState(conn, stateIdle) {
+			return
+		}
 
-		headers := response.SetDefaultHeaders(len(responseBody))
-		w.WriteHeaders(headers)
+		// a connection that goes idle is closed without a response
+		if err := conn.SetReadDeadline(time.Now().Add(s.timeouts.Idle)); err != nil {
+			return
+		}
+		if err := reader.WaitForRequest(); err != nil {
+			return
+		}
 
-		w.WriteBody(responseBody)
+		// both read timeouts are measured from the first byte of the request
+		start := time.Now()
+		if err := conn.SetReadDeadline(start.Add(s.timeouts.ReadHeader)); err != nil {
+			return
+		}
+
+		w := response.NewWriter(conn)
+		// a request that arrives during shutdown is still answered, but it is the last one
+		if !s.setState(conn, stateActive) {
+			w.CloseAfterResponse()
+		}
+
+		// parse incoming requests with the parser written earlier
+		req, err := reader.ReadRequest()
+		if err != nil {
+			// client hung up or the connection broke, nothing to respond to
+			var protocolErr *request.ProtocolError
+			if !errors.As(err, &protocolErr) {
+				return
+			}
+			if err := conn.SetWriteDeadline(time.Now().Add(s.timeouts.Write)); err != nil {
+				return
+			}
+
+			// respond with the status the parser picked, the rest of the stream can't be trusted
+			w.WriteError(response.StatusCode(protocolErr.StatusCode), err.Error())
+
+			return
+		}
+
+		// body reads by the handler past the deadline fail with a 408 protocol error
+		if err := conn.SetReadDeadline(start.Add(s.timeouts.Read)); err != nil {
+			return
+		}
+		// a client that stops reading the response can't hold on to the handler forever
+		if err := conn.SetWriteDeadline(time.Now().Add(s.timeouts.Write)); err != nil {
+			return
+		}
 
-		return
+		// answered in the version it was sent in, which decides how the response is framed
+		w.SetVersion(req.RequestLine.HttpVersion)
+		if !req.KeepAlive() {
+			w.CloseAfterResponse()
+		}
+		// the body is only asked for once the handler reads it, so it can be rejected unread, a
+		// body that was never asked for may still be sent, so the connection can't be reused
+		req.OnContinue(w.WriteContinue)
+		w.CloseWhen(req.ExpectsContinue)
+		// handlers written for GET answer HEAD too, whatever body they write is dropped
+		if req.RequestLine.Method == "HEAD" {
+			w.SuppressBody()
+		}
+
+		if s.pathRedirect != 0 && req.URL.Cleaned {
+			redirect(w, req, s.pathRedirect)
+		} else if !s.serve(w, req) {
+			return
+		}
+		// sends what the handler left buffered or unterminated
+		if err := w.Finish(); err != nil {
+			return
+		}
+
+		// whatever the handler didn't read is drained so the next request can be parsed
+		if err := req.Body.Close(); err != nil {
+			return
+		}
+
+		// the client can't tell where an unfinished response ends, so the connection can't be reused
+		if w.Closing() || !w.Done() {
+			return
+		}
 	}
+}
+
+// runs the handler, a panic is contained to the connection it happened on, reports false if it
+// happened since the connection can't be reused
+// #nosec G104
+func (s *Server) serve(w *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		err := recover()
+		if err == nil {
+			return
+		}
+		ok = false
+		if err == ErrAbortHandler {
+			return
+		}
+
+		log.Printf("panic handling %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, err, debug.Stack())
+
+		// once the status line is out, a 500 can't be sent, the connection is dropped instead so
+		// the client can tell the response was cut short
+		if w.StatusWritten() {
+			return
+		}
+
+		w.WriteError(response.StatusInternalServerError, "500 internal server error")
+	}()
 
 	s.handler(w, req)
+
+	return true
+}
+
+// points the client at the normalized path, the query is kept as it was
+// #nosec G104
+func redirect(w *response.Writer, req *request.Request, statusCode response.StatusCode) {
+	location := req.URL.RawPath
+	if req.URL.RawQuery != "" {
+		location += "?" + req.URL.RawQuery
+	}
+
+	w.Header().Set("Location", location)
+	w.WriteHeader(statusCode)
+	w.Write([]byte(fmt.Sprintf("redirecting to %s", location)))
 }
 
 func (s *Server) listen() {
@@ -59,13 +247,20 @@ func (s *Server) listen() {
 		}
 		log.Printf("connection with %s, accepted", conn.RemoteAddr().String())
 
+		if !s.trackConn(conn) {
+			conn.Close()
+			return
+		}
+
 		// handle in a goroutine so server can accept more connections
 		go s.handle(conn)
 	}
 }
 
+// stops accepting and closes every connection, including those with requests in flight
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	defer s.closeConns("")
 
 	if s.listener != nil {
 		if err := s.listener.Close(); err != nil {
@@ -78,7 +273,40 @@ func (s *Server) Close() error {
 	return nil
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+// stops accepting and closes idle connections, in-flight requests are left to finish before
+// their connections are closed, whatever remains when ctx expires is closed forcefully
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	s.closeConns(stateIdle)
+
+	var err error
+	if s.listener != nil {
+		if closeErr := s.listener.Close(); closeErr != nil {
+			err = fmt.Errorf("couldn't shutdown server properly: %v", closeErr)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.closeConns("")
+		return ctx.Err()
+	}
+}
+
+// address the server is listening on, useful when serving on port 0
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func Serve(port int, handler Handler, options ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, fmt.Errorf("couldn't setup a listener: %v", err)
@@ -87,6 +315,12 @@ func Serve(port int, handler Handler) (*Server, error) {
 	s := &Server{
 		handler:  handler,
 		listener: listener,
+		limits:   request.DefaultLimits,
+		timeouts: DefaultTimeouts,
+		conns:    map[net.Conn]connState{},
+	}
+	for _, option := range options {
+		option(s)
 	}
 	go s.listen()
 
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/junwei890/http-1.1/internal/request"
+	"github.com/junwei890/http-1.1/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoes the request body back, or the status of the protocol error hit while reading it
+// #nosec G104
+func echoHandler(w *response.Writer, r *request.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		statusCode := response.StatusBadRequest
+		var protocolErr *request.ProtocolError
+		if errors.As(err, &protocolErr) {
+			statusCode = response.StatusCode(protocolErr.StatusCode)
+		}
+		w.CloseAfterResponse()
+		w.WriteStatusLine(statusCode)
+		w.WriteHeaders(response.SetDefaultHeaders(0))
+		return
+	}
+
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.SetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func startServer(t *testing.T, handler Handler, options ...Option) net.Conn {
+	s, err := Serve(0, handler, options...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn
+}
+
+// simulates a slow client by writing a few bytes at a time with a delay in between
+func slowWrite(conn net.Conn, data string, numBytesPerWrite int, delay time.Duration) error {
+	for i := 0; i < len(data); i += numBytesPerWrite {
+		if _, err := conn.Write([]byte(data[i:min(i+numBytesPerWrite, len(data))])); err != nil {
+			return err
+		}
+		time.Sleep(delay)
+	}
+
+	return nil
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) (*http.Response, string) {
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return res, string(body)
+}
+
+// the server closed the connection without writing anything else
+func requireClosed(t *testing.T, reader *bufio.Reader) {
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn := startServer(t, echoHandler)
+	reader := bufio.NewReader(conn)
+
+	// test: several requests on the same connection
+	_, err := conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nfirst"))
+	require.NoError(t, err)
+	res, body := readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "first", body)
+	assert.False(t, res.Close)
+
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\nsecond"))
+	require.NoError(t, err)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "second", body)
+
+	// test: client asks for the connection to be closed
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, reader)
+	assert.True(t, res.Close)
+	requireClosed(t, reader)
+}
+
+func TestPipelining(t *testing.T) {
+	conn := startServer(t, echoHandler)
+	reader := bufio.NewReader(conn)
+
+	// test: responses come back in the order requests were sent
+	_, err := conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 3\r\n\r\nonePOST / HTTP/1.1\r\nContent-Length: 3\r\n\r\ntwoPOST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nthree\r\n0\r\n\r\n"))
+	require.NoError(t, err)
+
+	for _, expected := range []string{"one", "two", "three"} {
+		_, body := readResponse(t, reader)
+		assert.Equal(t, expected, body)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	timeouts := Timeouts{
+		ReadHeader: 100 * time.Millisecond,
+		Read:       300 * time.Millisecond,
+		Write:      300 * time.Millisecond,
+		Idle:       200 * time.Millisecond,
+	}
+
+	// test: slow client sending headers gets a 408
+	conn := startServer(t, echoHandler, WithTimeouts(timeouts))
+	reader := bufio.NewReader(conn)
+	err := slowWrite(conn, "GET / HTTP/1.1\r\nHost: loc", 8, 20*time.Millisecond)
+	require.NoError(t, err)
+	res, _ := readResponse(t, reader)
+	assert.Equal(t, 408, res.StatusCode)
+	requireClosed(t, reader)
+
+	// test: slow body gets a 408 once the full request timeout passes
+	conn = startServer(t, echoHandler, WithTimeouts(timeouts))
+	reader = bufio.NewReader(conn)
+	go slowWrite(conn, "POST / HTTP/1.1\r\nContent-Length: 64\r\n\r\n"+strings.Repeat("a", 64), 4, 30*time.Millisecond)
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 408, res.StatusCode)
+
+	// test: idle connection is closed without a response
+	conn = startServer(t, echoHandler, WithTimeouts(timeouts))
+	reader = bufio.NewReader(conn)
+	start := time.Now()
+	requireClosed(t, reader)
+	assert.GreaterOrEqual(t, time.Since(start), timeouts.Idle)
+
+	// test: idle timeout applies between keep-alive requests
+	conn = startServer(t, echoHandler, WithTimeouts(timeouts))
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	requireClosed(t, reader)
+
+	// test: client that stops reading the response doesn't hold the handler forever
+	writeErr := make(chan error, 1)
+	conn = startServer(t, func(w *response.Writer, r *request.Request) {
+		body := make([]byte, 64*1024*1024)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.SetDefaultHeaders(len(body)))
+		_, err := w.WriteBody(body)
+		writeErr <- err
+	}, WithTimeouts(timeouts))
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	select {
+	case err := <-writeErr:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write never timed out")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// test: in-flight request finishes, idle connection is closed straight away
+	started := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, r *request.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		echoHandler(w, r)
+	})
+	require.NoError(t, err)
+
+	busy, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer busy.Close()
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	_, err = busy.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 4\r\n\r\nbusy"))
+	require.NoError(t, err)
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	requireClosed(t, bufio.NewReader(idle))
+
+	reader := bufio.NewReader(busy)
+	res, body := readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "busy", body)
+	requireClosed(t, reader)
+	require.NoError(t, <-shutdownErr)
+
+	// test: new connections are refused
+	_, err = net.Dial("tcp", s.Addr().String())
+	require.Error(t, err)
+
+	// test: connections still busy when the context expires are closed forcefully
+	block := make(chan struct{})
+	defer close(block)
+	started = make(chan struct{})
+	s, err = Serve(0, func(w *response.Writer, r *request.Request) {
+		close(started)
+		<-block
+	})
+	require.NoError(t, err)
+
+	busy, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer busy.Close()
+	_, err = busy.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	requireClosed(t, bufio.NewReader(busy))
+}
+
+func TestChain(t *testing.T) {
+	order := []string{}
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, r *request.Request) {
+				order = append(order, name+" before")
+				next(w, r)
+				order = append(order, name+" after")
+			}
+		}
+	}
+
+	// test: first middleware is the outermost
+	handler := Chain(func(w *response.Writer, r *request.Request) {
+		order = append(order, "handler")
+	}, tag("first"), tag("second"))
+	handler(nil, nil)
+	assert.Equal(t, []string{"first before", "second before", "handler", "second after", "first after"}, order)
+
+	// test: no middleware leaves the handler as is
+	order = []string{}
+	Chain(func(w *response.Writer, r *request.Request) {
+		order = append(order, "handler")
+	})(nil, nil)
+	assert.Equal(t, []string{"handler"}, order)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	release := make(chan struct{})
+	s, err := Serve(0, func(w *response.Writer, r *request.Request) {
+		switch r.RequestLine.RequestTarget {
+		case "/panic":
+			panic("boom")
+		case "/panic-after-headers":
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.Header().Set("Set-Cookie", "session=abc")
+			w.Write([]byte("partial"))
+			panic("boom")
+		case "/panic-after-status":
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.SetDefaultHeaders(10))
+			w.WriteBody([]byte("trunc"))
+			panic("boom")
+		case "/slow":
+			<-release
+		}
+		echoHandler(w, r)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			conn.Close()
+		})
+		return conn, bufio.NewReader(conn)
+	}
+
+	// test: concurrent request is unaffected by a panicking one
+	slow, slowReader := dial()
+	_, err = slow.Write([]byte("POST /slow HTTP/1.1\r\nContent-Length: 4\r\n\r\nslow"))
+	require.NoError(t, err)
+
+	conn, reader := dial()
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ := readResponse(t, reader)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.True(t, res.Close)
+	requireClosed(t, reader)
+
+	close(release)
+	res, body := readResponse(t, slowReader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "slow", body)
+
+	// test: headers and body the handler left behind aren't sent with the 500
+	conn, reader = dial()
+	_, err = conn.Write([]byte("GET /panic-after-headers HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	res, body = readResponse(t, reader)
+	assert.Equal(t, 500, res.StatusCode)
+	assert.Empty(t, res.TransferEncoding)
+	assert.Empty(t, res.Header.Get("Set-Cookie"))
+	assert.Equal(t, "500 internal server error", body)
+	assert.True(t, res.Close)
+	requireClosed(t, reader)
+
+	// test: panic after the status line is written drops the connection
+	conn, reader = dial()
+	_, err = conn.Write([]byte("GET /panic-after-status HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	res, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(res.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// test: server keeps accepting connections
+	conn, reader = dial()
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nstill"))
+	require.NoError(t, err)
+	_, body = readResponse(t, reader)
+	assert.Equal(t, "still", body)
+}
+
+func TestHead(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		w.Write([]byte("hello world"))
+	}
+	conn := startServer(t, handler)
+	reader := bufio.NewReader(conn)
+
+	// test: HEAD gets the headers GET would, without the body
+	_, err := conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, err := http.ReadResponse(reader, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, int64(11), res.ContentLength)
+	assert.False(t, res.Close)
+
+	// test: the next response isn't thrown off by a body that was never sent
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, body := readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "hello world", body)
+}
+
+func TestExpectContinue(t *testing.T) {
+	// rejects uploads over 10 bytes without reading them
+	handler := func(w *response.Writer, r *request.Request) {
+		if r.RequestLine.RequestTarget == "/low-level" {
+			w.WriteStatusLine(response.StatusExpectationFailed)
+			w.WriteHeaders(response.SetDefaultHeaders(0))
+			return
+		}
+		length, _ := r.Headers.Get("Content-Length")
+		if n, _ := strconv.Atoi(length); n > 10 {
+			w.WriteHeader(response.StatusContentTooLarge)
+			return
+		}
+		echoHandler(w, r)
+	}
+	conn := startServer(t, handler)
+	reader := bufio.NewReader(conn)
+
+	// test: body is asked for once the handler reads it
+	_, err := conn.Write([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	res, body := readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.False(t, res.Close)
+
+	// test: handler rejects the body without it being sent
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 50\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 413, res.StatusCode)
+	assert.True(t, res.Close)
+	requireClosed(t, reader)
+
+	// test: headers written by hand before the body is asked for still say the connection closes
+	conn = startServer(t, handler)
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("POST /low-level HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 417, res.StatusCode)
+	assert.True(t, res.Close)
+	requireClosed(t, reader)
+}
+
+func TestPathRedirect(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		w.Write([]byte(r.URL.Path))
+	}
+
+	// test: handlers see the normalized path by default
+	conn := startServer(t, handler)
+	reader := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("GET /a/%2e%2e//image HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, body := readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "/image", body)
+
+	// test: non canonical paths are redirected with the query kept
+	conn = startServer(t, handler, WithPathRedirect(response.StatusPermanentRedirect))
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET /./images//cat%20photo.png?size=small HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 308, res.StatusCode)
+	assert.Equal(t, "/images/cat%20photo.png?size=small", res.Header.Get("Location"))
+	assert.False(t, res.Close)
+
+	// test: canonical paths are served as usual
+	_, err = conn.Write([]byte("GET /images/cat%20photo.png HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, body = readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "/images/cat photo.png", body)
+
+	// test: repeated and encoded slashes can be let through
+	conn = startServer(t, handler, WithDuplicateSlashes(), WithEncodedSlashes())
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET /repos/a%2Fb//issues HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, body = readResponse(t, reader)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "/repos/a/b//issues", body)
+
+	// test: encoded slashes are rejected otherwise
+	conn = startServer(t, handler)
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET /repos/a%2Fb HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ = readResponse(t, reader)
+	assert.Equal(t, 400, res.StatusCode)
+
+	// test: only permanent redirects can be used
+	assert.Panics(t, func() {
+		WithPathRedirect(response.StatusFound)
+	})
+}
+
+func TestHTTP10(t *testing.T) {
+	handler := func(w *response.Writer, r *request.Request) {
+		w.Write([]byte(strings.Repeat("a", 5000)))
+	}
+
+	// test: the connection is closed after the response unless asked otherwise
+	conn := startServer(t, handler)
+	reader := bufio.NewReader(conn)
+	_, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n", line)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.NotContains(t, string(rest), "Transfer-Encoding")
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\n"+strings.Repeat("a", 5000)))
+
+	// test: keep alive is honoured for bodies with a known length
+	conn = startServer(t, echoHandler)
+	reader = bufio.NewReader(conn)
+	for _, body := range []string{"first", "second"} {
+		_, err = conn.Write([]byte("POST / HTTP/1.0\r\nConnection: keep-alive\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body))
+		require.NoError(t, err)
+		res, resBody := readResponse(t, reader)
+		assert.Equal(t, "HTTP/1.0", res.Proto)
+		assert.Equal(t, "keep-alive", res.Header.Get("Connection"))
+		assert.Equal(t, body, resBody)
+	}
+
+	// test: newer versions are refused
+	conn = startServer(t, handler)
+	reader = bufio.NewReader(conn)
+	_, err = conn.Write([]byte("GET / HTTP/2.0\r\n\r\n"))
+	require.NoError(t, err)
+	res, _ := readResponse(t, reader)
+	assert.Equal(t, 505, res.StatusCode)
+}